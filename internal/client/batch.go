@@ -0,0 +1,92 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+	"github.com/pkg/errors"
+)
+
+// exportOperation is the API path ExportSobject calls, which batch request
+// items refer to.
+const exportOperation = "/crypto/v1/keys/export"
+
+// BatchExportSobjects exports security objects in a single DSM batch request.
+// It returns the objects in the order of descriptors, along with an error
+// for each object DSM failed to export. An error is returned if the batch
+// request itself fails.
+func (c *SecretClient) BatchExportSobjects(
+	ctx context.Context,
+	descriptors []sdkms.SobjectDescriptor,
+) ([]*sdkms.Sobject, []error, error) {
+	items := make([]sdkms.BatchRequest, len(descriptors))
+	for i, descriptor := range descriptors {
+		items[i] = sdkms.BatchRequest{SingleItem: &sdkms.BatchRequestItem{
+			Method:    http.MethodPost,
+			Operation: exportOperation,
+			Body:      descriptor,
+		}}
+	}
+	request := sdkms.BatchRequest{Batch: &sdkms.BatchRequestList{
+		BatchExecutionType: sdkms.BatchExecutionTypeUnordered,
+		Items:              items,
+	}}
+
+	var response *sdkms.BatchResponse
+	err := c.do(ctx, func(client *sdkms.Client) error {
+		var err error
+		response, err = client.Batch(ctx, request)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.Batch == nil || len(response.Batch.Items) != len(descriptors) {
+		return nil, nil, errors.New("unexpected DSM batch response")
+	}
+
+	sobjects := make([]*sdkms.Sobject, len(descriptors))
+	errs := make([]error, len(descriptors))
+	for i, item := range response.Batch.Items {
+		sobjects[i], errs[i] = batchExportResult(item.SingleItem)
+	}
+	return sobjects, errs, nil
+}
+
+// batchExportResult decodes the result of an export in a batch response.
+// Failed exports are returned as a BackendError, like ExportSobject does.
+func batchExportResult(item *sdkms.BatchResponseObject) (*sdkms.Sobject, error) {
+	switch {
+	case item == nil:
+		return nil, errors.New("unexpected DSM batch response item")
+	case item.Skipped != nil:
+		return nil, errors.Errorf("skipped by DSM: %s", item.Skipped.Reason)
+	case item.Result == nil:
+		return nil, errors.New("unexpected DSM batch response item")
+	}
+
+	body, err := json.Marshal(item.Result.Body)
+	if err != nil {
+		return nil, err
+	}
+	if item.Result.Status >= http.StatusMultipleChoices {
+		message, ok := item.Result.Body.(string)
+		if !ok {
+			message = string(body)
+		}
+		return nil, &sdkms.BackendError{StatusCode: int(item.Result.Status), Message: message}
+	}
+	var sobject sdkms.Sobject
+	if err := json.Unmarshal(body, &sobject); err != nil {
+		return nil, errors.Wrap(err, "failed to decode exported object")
+	}
+	return &sobject, nil
+}
@@ -0,0 +1,215 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package client
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// breakerFailureThreshold is the number of consecutive failed requests
+	// after which the circuit breaker of an endpoint opens.
+	breakerFailureThreshold = 5
+	// breakerOpenDuration is how long an open circuit breaker fails requests
+	// before letting a probe request through.
+	breakerOpenDuration = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned for requests to a DSM endpoint that failed
+// repeatedly, without making the request.
+var ErrCircuitOpen = errors.New("DSM circuit breaker is open")
+
+// BreakerState is the state of the circuit breaker of a DSM endpoint.
+type BreakerState string
+
+const (
+	// BreakerClosed lets requests through.
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen fails requests without making them.
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single probe request through, whose outcome
+	// closes or opens the breaker again.
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// circuitBreaker stops requests to a DSM endpoint that is down, so that
+// mounts fail fast instead of piling up. Network errors and 5xx responses
+// count as failures, any other response as success. The breaker is shared by
+// all tenants of the endpoint, so errors caused by the transport settings of a
+// tenant, such as an untrusted certificate or a broken proxy, do not count.
+type circuitBreaker struct {
+	endpoint string
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+}
+
+// allow reports whether a request may be made. Once the breaker has been
+// open for breakerOpenDuration, it lets one probe request through.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < breakerOpenDuration {
+			return false
+		}
+		slog.Info("DSM circuit breaker half-open, probing", "endpoint", b.endpoint)
+		b.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+func (b *circuitBreaker) record(success bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if success {
+		if b.state != BreakerClosed {
+			slog.Info("DSM circuit breaker closed", "endpoint", b.endpoint)
+		}
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= breakerFailureThreshold {
+		if b.state != BreakerOpen {
+			slog.Warn("DSM circuit breaker open", "endpoint", b.endpoint, "failures", b.failures)
+		}
+		b.state = BreakerOpen
+		b.openedAt = now
+	}
+}
+
+// release undoes allow for a request whose outcome is unknown.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.state = BreakerOpen
+		b.openedAt = time.Time{}
+	}
+}
+
+func (b *circuitBreaker) currentState() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+type breakerRegistry struct {
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+var breakers = &breakerRegistry{breakers: make(map[string]*circuitBreaker)}
+
+// get returns the circuit breaker of a DSM endpoint, which all clients for
+// the endpoint share.
+func (r *breakerRegistry) get(endpoint string) *circuitBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	breaker, ok := r.breakers[endpoint]
+	if !ok {
+		breaker = &circuitBreaker{endpoint: endpoint, state: BreakerClosed}
+		r.breakers[endpoint] = breaker
+	}
+	return breaker
+}
+
+// BreakerStates returns the state of the circuit breaker of each DSM
+// endpoint requests were made to.
+func BreakerStates() map[string]BreakerState {
+	breakers.mu.Lock()
+	defer breakers.mu.Unlock()
+	states := make(map[string]BreakerState, len(breakers.breakers))
+	for endpoint, breaker := range breakers.breakers {
+		states[endpoint] = breaker.currentState()
+	}
+	return states
+}
+
+// breakerTransport makes requests through the circuit breaker of their
+// endpoint. It wraps retryTransport, so a request only counts as failed once
+// its retries are exhausted.
+type breakerTransport struct {
+	breaker *circuitBreaker
+	// proxy returns the proxy of a request, as http.Transport.Proxy does. It
+	// is nil if requests are made directly.
+	proxy func(*http.Request) (*url.URL, error)
+	next  http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.allow(time.Now()) {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, ErrCircuitOpen
+	}
+	// connected tracks whether the last attempt got a connection to DSM,
+	// through the proxy if any.
+	var connected atomic.Bool
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GetConn: func(string) { connected.Store(false) },
+		GotConn: func(httptrace.GotConnInfo) { connected.Store(true) },
+	}))
+	resp, err := t.next.RoundTrip(req)
+	if req.Context().Err() != nil || errors.Is(err, ErrRateLimited) ||
+		(err != nil && !t.dsmFailure(req, err, connected.Load())) {
+		// The mount gave up, the request was never made, or it failed
+		// because of the transport settings of the tenant, which says
+		// nothing about DSM. A probe that was released lets the next
+		// request probe.
+		t.breaker.release()
+		return resp, err
+	}
+	success := err == nil &&
+		(resp.StatusCode < http.StatusInternalServerError || resp.StatusCode == http.StatusNotImplemented)
+	t.breaker.record(success, time.Now())
+	return resp, err
+}
+
+// dsmFailure reports whether a request that failed with err says something
+// about DSM. TLS verification failures depend on the trust settings of the
+// tenant, and errors before a connection was made through a proxy may come
+// from the proxy of the tenant.
+func (t *breakerTransport) dsmFailure(req *http.Request, err error, connected bool) bool {
+	if IsTLSConfigError(err) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "proxyconnect" {
+		return false
+	}
+	if !connected && t.proxy != nil {
+		if proxyURL, _ := t.proxy(req); proxyURL != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *breakerTransport) CloseIdleConnections() {
+	if closer, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,216 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// Each step makes a request at offset after the start, if the breaker
+	// allows it, and records its outcome.
+	type step struct {
+		offset    time.Duration
+		success   bool
+		release   bool
+		wantAllow bool
+		wantState BreakerState
+	}
+	fail := func(offset time.Duration, wantState BreakerState) step {
+		return step{offset: offset, wantAllow: true, wantState: wantState}
+	}
+	closedFailures := func(n int) []step {
+		steps := make([]step, 0, n)
+		for i := 0; i < n; i++ {
+			steps = append(steps, fail(0, BreakerClosed))
+		}
+		return steps
+	}
+	// failures makes the breaker open after n failed requests.
+	failures := func(n int) []step {
+		return append(closedFailures(n-1), fail(0, BreakerOpen))
+	}
+	afterOpen := breakerOpenDuration + time.Second
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "opens after consecutive failures",
+			steps: failures(breakerFailureThreshold),
+		},
+		{
+			name: "success resets the failure count",
+			steps: append(append(closedFailures(breakerFailureThreshold-1),
+				step{success: true, wantAllow: true, wantState: BreakerClosed}),
+				closedFailures(breakerFailureThreshold-1)...),
+		},
+		{
+			name: "open breaker fails requests",
+			steps: append(failures(breakerFailureThreshold),
+				step{offset: breakerOpenDuration / 2, wantAllow: false, wantState: BreakerOpen}),
+		},
+		{
+			name: "successful probe closes the breaker",
+			steps: append(failures(breakerFailureThreshold),
+				step{offset: afterOpen, success: true, wantAllow: true, wantState: BreakerClosed},
+				step{offset: afterOpen, success: true, wantAllow: true, wantState: BreakerClosed}),
+		},
+		{
+			name: "failed probe opens the breaker again",
+			steps: append(failures(breakerFailureThreshold),
+				fail(afterOpen, BreakerOpen),
+				step{offset: afterOpen + time.Second, wantAllow: false, wantState: BreakerOpen}),
+		},
+		{
+			name: "released probe lets the next request probe",
+			steps: append(failures(breakerFailureThreshold),
+				step{offset: afterOpen, release: true, wantAllow: true, wantState: BreakerOpen},
+				step{offset: afterOpen, success: true, wantAllow: true, wantState: BreakerClosed}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			breaker := &circuitBreaker{endpoint: "https://dsm.example.com", state: BreakerClosed}
+			for i, s := range tt.steps {
+				now := start.Add(s.offset)
+				allowed := breaker.allow(now)
+				if allowed != s.wantAllow {
+					t.Fatalf("step %d: allow() = %v, want %v", i, allowed, s.wantAllow)
+				}
+				if allowed {
+					if s.release {
+						breaker.release()
+					} else {
+						breaker.record(s.success, now)
+					}
+				}
+				if state := breaker.currentState(); state != s.wantState {
+					t.Fatalf("step %d: state = %s, want %s", i, state, s.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerAllowsOneProbe(t *testing.T) {
+	breaker := &circuitBreaker{state: BreakerClosed}
+	now := time.Now()
+	for i := 0; i < breakerFailureThreshold; i++ {
+		breaker.allow(now)
+		breaker.record(false, now)
+	}
+
+	probeTime := now.Add(breakerOpenDuration)
+	if !breaker.allow(probeTime) {
+		t.Fatal("breaker did not let a probe through")
+	}
+	if state := breaker.currentState(); state != BreakerHalfOpen {
+		t.Fatalf("state = %s, want %s", state, BreakerHalfOpen)
+	}
+	if breaker.allow(probeTime) {
+		t.Error("breaker let a second request through while probing")
+	}
+}
+
+// stubTransport fails requests with err, or returns resp. connect, if set,
+// reports a connection to the trace of the request first.
+type stubTransport struct {
+	connect bool
+	resp    *http.Response
+	err     error
+}
+
+func (t *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if trace := httptrace.ContextClientTrace(req.Context()); trace != nil {
+		trace.GetConn(req.URL.Host)
+		if t.connect {
+			trace.GotConn(httptrace.GotConnInfo{})
+		}
+	}
+	return t.resp, t.err
+}
+
+func TestBreakerTransportCountsOnlyDSMFailures(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	viaProxy := func(*http.Request) (*url.URL, error) {
+		return &url.URL{Scheme: "http", Host: "proxy.example.com:3128"}, nil
+	}
+	noProxy := func(*http.Request) (*url.URL, error) { return nil, nil }
+	tests := []struct {
+		name      string
+		proxy     func(*http.Request) (*url.URL, error)
+		next      *stubTransport
+		wantState BreakerState
+	}{
+		{
+			name:      "server errors",
+			next:      &stubTransport{connect: true, resp: &http.Response{StatusCode: http.StatusServiceUnavailable}},
+			wantState: BreakerOpen,
+		},
+		{
+			name:      "dial errors",
+			proxy:     noProxy,
+			next:      &stubTransport{err: dialErr},
+			wantState: BreakerOpen,
+		},
+		{
+			name:      "read errors through a proxy",
+			proxy:     viaProxy,
+			next:      &stubTransport{connect: true, err: io.ErrUnexpectedEOF},
+			wantState: BreakerOpen,
+		},
+		{
+			name:      "TLS verification failures",
+			next:      &stubTransport{err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}},
+			wantState: BreakerClosed,
+		},
+		{
+			name:      "pin mismatches",
+			next:      &stubTransport{err: errPinMismatch},
+			wantState: BreakerClosed,
+		},
+		{
+			name:      "proxy dial errors",
+			proxy:     viaProxy,
+			next:      &stubTransport{err: &net.OpError{Op: "proxyconnect", Net: "tcp", Err: syscall.ECONNREFUSED}},
+			wantState: BreakerClosed,
+		},
+		{
+			name:      "proxy CONNECT failures",
+			proxy:     viaProxy,
+			next:      &stubTransport{err: errors.New("Forbidden")},
+			wantState: BreakerClosed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := &circuitBreaker{endpoint: "https://dsm.example.com", state: BreakerClosed}
+			transport := &breakerTransport{breaker: breaker, proxy: tt.proxy, next: tt.next}
+			for i := 0; i < breakerFailureThreshold; i++ {
+				req := httptest.NewRequest(http.MethodGet, "https://dsm.example.com/sys/v1/version", nil)
+				_, _ = transport.RoundTrip(req)
+			}
+			if state := breaker.currentState(); state != tt.wantState {
+				t.Errorf("state = %s, want %s", state, tt.wantState)
+			}
+		})
+	}
+}
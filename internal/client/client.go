@@ -7,17 +7,30 @@
 package client
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/fortanix/sdkms-client-go/sdkms"
 	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
 
 	"github.com/fortanix/fortanix-csi-provider/internal/config"
 )
 
+// SecretClient makes requests to DSM in a session, which is established on
+// first use and shared by all clients with the same credential.
 type SecretClient struct {
 	*sdkms.Client
+	parameters    config.SpcParameters
+	credentialKey string
 }
 
 func NewSecretClient(parameters config.SpcParameters) (*SecretClient, error) {
@@ -25,14 +38,326 @@ func NewSecretClient(parameters config.SpcParameters) (*SecretClient, error) {
 		slog.Error("Endpoint empty")
 		return nil, errors.Errorf("Could not find an endpoint")
 	}
-	if parameters.ApiKey == "" {
-		slog.Error("Api Key empty")
-		return nil, errors.Errorf("Could not find an api key")
-	}
 	client := sdkms.Client{
-		HTTPClient: http.DefaultClient,
-		Auth:       sdkms.APIKey(parameters.ApiKey),
-		Endpoint:   parameters.DsmEndpoint,
+		Endpoint: parameters.DsmEndpoint,
+	}
+	var clientCert *tls.Certificate
+	switch parameters.AuthMethod {
+	case config.AuthMethodJWT:
+		if parameters.AppID == "" || parameters.JWT == "" {
+			slog.Error("App ID or JWT empty")
+			return nil, errors.Errorf("Could not find an app ID and JWT")
+		}
+	case config.AuthMethodCertificate:
+		if parameters.AppID == "" {
+			slog.Error("App ID empty")
+			return nil, errors.Errorf("Could not find an app ID")
+		}
+		cert, err := tls.X509KeyPair(parameters.ClientCert, parameters.ClientKey)
+		if err != nil {
+			slog.Error("Invalid client certificate", "error", err)
+			return nil, errors.Wrap(err, "Could not load the client certificate")
+		}
+		clientCert = &cert
+	default:
+		if parameters.ApiKey == "" {
+			slog.Error("Api Key empty")
+			return nil, errors.Errorf("Could not find an api key")
+		}
+		client.Auth = sdkms.APIKey(parameters.ApiKey)
+	}
+	transport, err := newTransport(clientCert, parameters.DsmEndpoint, parameters.TLS, parameters.Proxy, parameters.Timeouts)
+	if err != nil {
+		slog.Error("Invalid TLS settings", "error", err)
+		return nil, errors.Wrap(err, "Could not configure TLS")
+	}
+	credentialKey := CredentialKey(parameters)
+
+	// Requests go through the circuit breaker of the endpoint, are retried
+	// on transient failures, and each attempt is rate limited.
+	client.HTTPClient = &http.Client{Transport: &breakerTransport{
+		breaker: breakers.get(parameters.DsmEndpoint),
+		proxy:   transport.Proxy,
+		next: &retryTransport{next: &rateLimitTransport{
+			endpoint: parameters.DsmEndpoint,
+			buckets:  buckets,
+			limits:   rateLimits(parameters, credentialKey),
+			next:     transport,
+		}},
+	}}
+	return &SecretClient{
+		Client:        &client,
+		parameters:    parameters,
+		credentialKey: credentialKey,
+	}, nil
+}
+
+// maxIdleConnsPerHost is the number of connections kept alive to DSM per
+// client. Mounts reuse clients, so it allows concurrent mounts to skip the TLS
+// handshake.
+const maxIdleConnsPerHost = 16
+
+// newTransport returns the HTTP transport used to reach DSM at endpoint.
+// clientCert, if set, is presented for certificate authentication.
+func newTransport(
+	clientCert *tls.Certificate,
+	endpoint string,
+	tlsConfig config.TLSConfig,
+	proxyConfig config.ProxyConfig,
+	timeouts config.Timeouts,
+) (*http.Transport, error) {
+	rootCAs, err := tlsConfig.CertPool()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	if timeouts.Connect > 0 {
+		dialer := &net.Dialer{Timeout: timeouts.Connect, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = timeouts.Connect
+	}
+	transport.ResponseHeaderTimeout = timeouts.Read
+	if proxyConfig.URL != "" {
+		proxy := httpproxy.Config{
+			HTTPProxy:  proxyConfig.URL,
+			HTTPSProxy: proxyConfig.URL,
+			NoProxy:    proxyConfig.NoProxy,
+		}
+		proxyFunc := proxy.ProxyFunc()
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+
+	dsmHost := tlsConfig.ServerName
+	if dsmHost == "" {
+		endpointURL, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		dsmHost = endpointURL.Hostname()
+	}
+	verifier := &connectionVerifier{dsmHost: dsmHost, pins: tlsConfig.PinnedSHA256}
+	if proxyConfig.UsesTLS() {
+		verifier.proxyHost = proxyConfig.Hostname()
+	}
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    rootCAs,
+		MinVersion: tlsConfig.Version(),
+		ServerName: tlsConfig.ServerName,
+	}
+	// The TLS configuration applies to the connection to an HTTPS proxy as
+	// well. The proxy CA must only be trusted for the proxy, which crypto/tls
+	// cannot do, so it skips verification and the verifier checks each
+	// connection against the roots of its peer.
+	if len(proxyConfig.CACert) > 0 && verifier.proxyHost != "" {
+		verifier.dsmRoots = rootCAs
+		verifier.proxyRoots = x509.NewCertPool()
+		if !verifier.proxyRoots.AppendCertsFromPEM(proxyConfig.CACert) {
+			return nil, errors.New("no valid PEM certificate in the proxy CA bundle")
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	if verifier.proxyRoots != nil || len(verifier.pins) > 0 {
+		transport.TLSClientConfig.VerifyConnection = verifier.verify
+	}
+	if clientCert != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	return transport, nil
+}
+
+// connectionVerifier checks the TLS connections of a transport, which are made
+// either to DSM at dsmHost or to an HTTPS proxy at proxyHost.
+type connectionVerifier struct {
+	dsmHost   string
+	proxyHost string
+	// pins are hex encoded SHA-256 hashes of the SubjectPublicKeyInfo of
+	// certificates, one of which must be in the chain of DSM.
+	pins []string
+	// dsmRoots and proxyRoots are set if crypto/tls skips verification, in
+	// which case the certificates of DSM and the proxy are verified against
+	// them.
+	dsmRoots   *x509.CertPool
+	proxyRoots *x509.CertPool
+}
+
+func (v *connectionVerifier) verify(cs tls.ConnectionState) error {
+	if v.isProxy(cs) {
+		if v.proxyRoots == nil {
+			return nil
+		}
+		_, err := verifyChain(cs, v.proxyHost, v.proxyRoots)
+		return err
+	}
+
+	chains := cs.VerifiedChains
+	if v.proxyRoots != nil {
+		var err error
+		if chains, err = verifyChain(cs, v.dsmHost, v.dsmRoots); err != nil {
+			return err
+		}
+	}
+	return verifyPins(chains, v.pins, v.dsmHost)
+}
+
+// isProxy reports whether a connection is made to the proxy. Connections are
+// told apart by their server name, which is empty for IP addresses, so
+// ambiguous connections count as made to DSM and are verified as such.
+func (v *connectionVerifier) isProxy(cs tls.ConnectionState) bool {
+	return v.proxyHost != "" && net.ParseIP(v.proxyHost) == nil &&
+		v.proxyHost != v.dsmHost && cs.ServerName == v.proxyHost
+}
+
+// verifyChain verifies the certificate of the peer of a connection for name
+// against roots, like crypto/tls does with its RootCAs.
+func verifyChain(cs tls.ConnectionState, name string, roots *x509.CertPool) ([][]*x509.Certificate, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return nil, errors.Errorf("%s presented no certificate", name)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := cs.PeerCertificates[0].Verify(opts)
+	if err != nil {
+		return nil, &tls.CertificateVerificationError{UnverifiedCertificates: cs.PeerCertificates, Err: err}
+	}
+	return chains, nil
+}
+
+// verifyPins checks that one of the certificates in the verified chains of
+// the connection to host has the public key of one of pins.
+func verifyPins(chains [][]*x509.Certificate, pins []string, host string) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if hex.EncodeToString(hash[:]) == pin {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.Wrapf(errPinMismatch, "the certificate of %s", host)
+}
+
+// errPinMismatch is returned for connections to a DSM endpoint whose
+// certificate has none of the pinned public keys.
+var errPinMismatch = errors.New("no pinned public key matches")
+
+// IsTLSConfigError reports whether err is a failure to verify the peer of a
+// TLS connection, or a TLS alert sent by it. Such failures point at the TLS
+// settings, e.g. a wrong CA, server name or pin, rather than at an outage.
+func IsTLSConfigError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var alertErr tls.AlertError
+	return errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) ||
+		errors.As(err, &alertErr) ||
+		errors.Is(err, errPinMismatch)
+}
+
+// CredentialKey identifies the DSM endpoint and credential of the client.
+func (c *SecretClient) CredentialKey() string {
+	return c.credentialKey
+}
+
+// Close closes the idle connections of the client. It can still be used
+// afterwards, opening new connections.
+func (c *SecretClient) Close() {
+	c.HTTPClient.CloseIdleConnections()
+}
+
+// Authenticate establishes a session, unless there is one already.
+func (c *SecretClient) Authenticate(ctx context.Context) error {
+	_, err := c.authorizedClient(ctx)
+	return err
+}
+
+// ExportSobject exports a security object.
+func (c *SecretClient) ExportSobject(ctx context.Context, body sdkms.SobjectDescriptor) (*sdkms.Sobject, error) {
+	var sobject *sdkms.Sobject
+	err := c.do(ctx, func(client *sdkms.Client) error {
+		var err error
+		sobject, err = client.ExportSobject(ctx, body)
+		return err
+	})
+	return sobject, err
+}
+
+// GetSobject looks up a security object.
+func (c *SecretClient) GetSobject(
+	ctx context.Context,
+	queryParameters *sdkms.GetSobjectParams,
+	body sdkms.SobjectDescriptor,
+) (*sdkms.Sobject, error) {
+	var sobject *sdkms.Sobject
+	err := c.do(ctx, func(client *sdkms.Client) error {
+		var err error
+		sobject, err = client.GetSobject(ctx, queryParameters, body)
+		return err
+	})
+	return sobject, err
+}
+
+// do makes a request in the session. If DSM rejects the session, e.g.
+// because it was terminated before its expiry, the request is retried once in
+// a new session.
+func (c *SecretClient) do(ctx context.Context, request func(*sdkms.Client) error) error {
+	client, err := c.authorizedClient(ctx)
+	if err != nil {
+		return err
+	}
+	err = request(client)
+	var backendErr *sdkms.BackendError
+	if errors.As(err, &backendErr) && backendErr.StatusCode == http.StatusUnauthorized {
+		slog.Info("DSM session rejected, authenticating again")
+		sessions.get(c.credentialKey, time.Now()).invalidate(client.Auth)
+		client, err = c.authorizedClient(ctx)
+		if err != nil {
+			return err
+		}
+		err = request(client)
+	}
+	return err
+}
+
+// authorizedClient returns an sdkms client to make a request in the session
+// with. Each request gets its own client so that renewing the session does
+// not race requests in flight.
+func (c *SecretClient) authorizedClient(ctx context.Context) (*sdkms.Client, error) {
+	auth, err := sessions.get(c.credentialKey, time.Now()).authorization(ctx, c.authenticate)
+	if err != nil {
+		return nil, err
+	}
+	return &sdkms.Client{Endpoint: c.Endpoint, HTTPClient: c.HTTPClient, Auth: auth}, nil
+}
+
+func (c *SecretClient) authenticate(ctx context.Context) (*sdkms.AuthenticationResponse, error) {
+	authClient := sdkms.Client{Endpoint: c.Endpoint, HTTPClient: c.HTTPClient}
+	switch c.parameters.AuthMethod {
+	case config.AuthMethodJWT:
+		// DSM apps with JWT authentication take the app ID as user name and
+		// the JWT as password.
+		return authClient.AuthenticateWithUserPass(ctx, c.parameters.AppID, c.parameters.JWT)
+	case config.AuthMethodCertificate:
+		// With certificate authentication the client certificate
+		// authenticates the app, there is no password.
+		return authClient.AuthenticateWithUserPass(ctx, c.parameters.AppID, "")
 	}
-	return &SecretClient{&client}, nil
+	return authClient.AuthenticateWithAPIKey(ctx, c.parameters.ApiKey)
 }
@@ -0,0 +1,245 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a server certificate for host signed by the CA.
+func (ca *testCA) issue(t *testing.T, host string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestConnectionVerifierSeparatesProxyCA(t *testing.T) {
+	const (
+		dsmHost   = "dsm.example.com"
+		proxyHost = "proxy.example.com"
+	)
+	dsmCA := newTestCA(t, "DSM CA")
+	proxyCA := newTestCA(t, "Proxy CA")
+	verifier := &connectionVerifier{
+		dsmHost:    dsmHost,
+		proxyHost:  proxyHost,
+		dsmRoots:   dsmCA.pool(),
+		proxyRoots: proxyCA.pool(),
+	}
+
+	tests := []struct {
+		name       string
+		serverName string
+		cert       *x509.Certificate
+		wantErr    bool
+	}{
+		{name: "DSM", serverName: dsmHost, cert: dsmCA.issue(t, dsmHost)},
+		{name: "proxy", serverName: proxyHost, cert: proxyCA.issue(t, proxyHost)},
+		{name: "DSM impersonated by the proxy CA", serverName: dsmHost, cert: proxyCA.issue(t, dsmHost), wantErr: true},
+		{name: "proxy with the DSM CA", serverName: proxyHost, cert: dsmCA.issue(t, proxyHost), wantErr: true},
+		{name: "DSM with another name", serverName: dsmHost, cert: dsmCA.issue(t, "other.example.com"), wantErr: true},
+		{name: "proxy certificate for DSM", serverName: dsmHost, cert: proxyCA.issue(t, proxyHost), wantErr: true},
+		{name: "no server name", serverName: "", cert: proxyCA.issue(t, proxyHost), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := tls.ConnectionState{ServerName: tt.serverName, PeerCertificates: []*x509.Certificate{tt.cert}}
+			err := verifier.verify(cs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !IsTLSConfigError(err) {
+				t.Errorf("verify() error %v is not a TLS config error", err)
+			}
+		})
+	}
+}
+
+func TestNewTransportKeepsProxyCAOutOfDSMRoots(t *testing.T) {
+	proxyCA := newTestCA(t, "Proxy CA")
+	proxyCAPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: proxyCA.cert.Raw})
+	tests := []struct {
+		name           string
+		proxyURL       string
+		wantSkipVerify bool
+	}{
+		{name: "https proxy", proxyURL: "https://proxy.example.com:3128", wantSkipVerify: true},
+		{name: "http proxy", proxyURL: "http://proxy.example.com:3128"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := newTransport(nil, "https://dsm.example.com", config.TLSConfig{},
+				config.ProxyConfig{URL: tt.proxyURL, CACert: proxyCAPEM}, config.Timeouts{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig := transport.TLSClientConfig
+			if tlsConfig.InsecureSkipVerify != tt.wantSkipVerify {
+				t.Errorf("InsecureSkipVerify = %v, want %v", tlsConfig.InsecureSkipVerify, tt.wantSkipVerify)
+			}
+			if tt.wantSkipVerify && tlsConfig.VerifyConnection == nil {
+				t.Fatal("verification is skipped without a VerifyConnection check")
+			}
+			impersonated := proxyCA.issue(t, "dsm.example.com")
+			if _, err := impersonated.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs}); err == nil {
+				t.Error("the proxy CA is trusted for DSM")
+			}
+		})
+	}
+}
+
+// pinOf returns the pin of the public key of cert.
+func pinOf(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(hash[:])
+}
+
+func TestVerifyPins(t *testing.T) {
+	ca := newTestCA(t, "DSM CA")
+	leaf := ca.issue(t, "dsm.example.com")
+	chains := [][]*x509.Certificate{{leaf, ca.cert}}
+	other := newTestCA(t, "Other CA")
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr bool
+	}{
+		{name: "no pins"},
+		{name: "leaf pinned", pins: []string{pinOf(leaf)}},
+		{name: "CA pinned", pins: []string{pinOf(ca.cert)}},
+		{name: "one of several pins", pins: []string{pinOf(other.cert), pinOf(ca.cert)}},
+		{name: "no pin matches", pins: []string{pinOf(other.cert)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyPins(chains, tt.pins, "dsm.example.com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyPins() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !IsTLSConfigError(err) {
+				t.Errorf("IsTLSConfigError(%v) = false, want true", err)
+			}
+		})
+	}
+}
+
+func TestClientChecksPins(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(testAuthResponse("token"))
+	}))
+	defer server.Close()
+	other := newTestCA(t, "Other CA")
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr bool
+	}{
+		{name: "pinned", pins: []string{pinOf(server.Certificate())}},
+		{name: "not pinned", pins: []string{pinOf(other.cert)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewSecretClient(config.SpcParameters{
+				DsmEndpoint: server.URL,
+				ApiKey:      "api-key-" + tt.name,
+				TLS: config.TLSConfig{
+					CACert:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+					PinnedSHA256: tt.pins,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = client.Authenticate(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !IsTLSConfigError(err) {
+				t.Errorf("IsTLSConfigError(%v) = false, want true", err)
+			}
+		})
+	}
+}
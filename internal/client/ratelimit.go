@@ -0,0 +1,226 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+// ErrRateLimited is returned for requests to DSM that could not be made
+// within the deadline of their context because of the client-side rate limit.
+var ErrRateLimited = errors.New("DSM client-side rate limit exceeded")
+
+// Metrics on throttled requests, keyed by DSM endpoint. They are not
+// published to the expvar registry, whose handler would also serve the
+// command line, and are served by the health listener via RateLimitMetrics
+// instead.
+var (
+	throttledRequests = new(expvar.Map)
+	throttledSeconds  = new(expvar.Map)
+	rejectedRequests  = new(expvar.Map)
+)
+
+// RateLimitMetrics returns the metrics on throttled requests as JSON objects
+// keyed by DSM endpoint.
+func RateLimitMetrics() map[string]json.RawMessage {
+	return map[string]json.RawMessage{
+		"dsm_throttled_requests":    json.RawMessage(throttledRequests.String()),
+		"dsm_throttled_seconds":     json.RawMessage(throttledSeconds.String()),
+		"dsm_rate_limited_requests": json.RawMessage(rejectedRequests.String()),
+	}
+}
+
+// tokenBucket limits requests to rate per second, allowing bursts of up to
+// burst requests.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// reserve takes a token and returns how long to wait until it is available.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel returns a token taken by reserve for a request that is not made.
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+1)
+}
+
+// idle reports whether the bucket is full, i.e. dropping it loses nothing.
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// bucketIdleTimeout is how long a full token bucket is kept after its last
+// use. A full bucket is the same as a new one, so dropping it loses nothing,
+// but requests that just looked it up must still find it.
+const bucketIdleTimeout = time.Minute
+
+type registeredBucket struct {
+	bucket   *tokenBucket
+	lastUsed time.Time
+}
+
+type bucketRegistry struct {
+	mu        sync.Mutex
+	buckets   map[string]*registeredBucket
+	lastSweep time.Time
+}
+
+var buckets = newBucketRegistry()
+
+func newBucketRegistry() *bucketRegistry {
+	return &bucketRegistry{buckets: make(map[string]*registeredBucket)}
+}
+
+// get returns the token bucket for key, or nil if rate is unlimited. Full
+// buckets unused for bucketIdleTimeout are dropped, so that buckets of
+// short-lived credentials do not pile up.
+func (r *bucketRegistry) get(key string, rate float64, burst int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.lastSweep) >= bucketIdleTimeout {
+		r.lastSweep = now
+		for k, registered := range r.buckets {
+			if now.Sub(registered.lastUsed) >= bucketIdleTimeout && registered.bucket.idle(now) {
+				delete(r.buckets, k)
+			}
+		}
+	}
+	registered, ok := r.buckets[key]
+	if !ok {
+		registered = &registeredBucket{bucket: newTokenBucket(rate, burst, now)}
+		r.buckets[key] = registered
+	}
+	registered.lastUsed = now
+	return registered.bucket
+}
+
+// rateLimit identifies a token bucket in the registry.
+type rateLimit struct {
+	key   string
+	rate  float64
+	burst int
+}
+
+// rateLimits returns the rate limits of the endpoint and credential of
+// parameters, whose token buckets all clients for them share.
+func rateLimits(parameters config.SpcParameters, credentialKey string) []rateLimit {
+	limits := parameters.RateLimits
+	return []rateLimit{
+		{key: "endpoint\x00" + parameters.DsmEndpoint, rate: limits.EndpointRate, burst: limits.EndpointBurst},
+		{key: "credential\x00" + credentialKey, rate: limits.CredentialRate, burst: limits.CredentialBurst},
+	}
+}
+
+// rateLimitTransport makes requests once the token buckets of their endpoint
+// and credential allow it. Requests queue until then, unless that would
+// exceed the deadline of their context. It is wrapped by retryTransport, so
+// retries are limited as well. The buckets are looked up for each request, so
+// that clients never hold on to a bucket the registry dropped.
+type rateLimitTransport struct {
+	endpoint string
+	buckets  *bucketRegistry
+	limits   []rateLimit
+	next     http.RoundTripper
+}
+
+// tokenBuckets returns the token buckets the request has to take a token
+// from.
+func (t *rateLimitTransport) tokenBuckets(now time.Time) []*tokenBucket {
+	var tokenBuckets []*tokenBucket
+	for _, limit := range t.limits {
+		if bucket := t.buckets.get(limit.key, limit.rate, limit.burst, now); bucket != nil {
+			tokenBuckets = append(tokenBuckets, bucket)
+		}
+	}
+	return tokenBuckets
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	now := time.Now()
+	tokenBuckets := t.tokenBuckets(now)
+	var delay time.Duration
+	for _, bucket := range tokenBuckets {
+		delay = max(delay, bucket.reserve(now))
+	}
+	if delay > 0 {
+		if err := t.wait(ctx, delay); err != nil {
+			for _, bucket := range tokenBuckets {
+				bucket.cancel()
+			}
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+func (t *rateLimitTransport) wait(ctx context.Context, delay time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		rejectedRequests.Add(t.endpoint, 1)
+		return ErrRateLimited
+	}
+	throttledRequests.Add(t.endpoint, 1)
+	throttledSeconds.AddFloat(t.endpoint, delay.Seconds())
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (t *rateLimitTransport) CloseIdleConnections() {
+	if closer, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
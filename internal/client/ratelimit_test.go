@@ -0,0 +1,175 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+func rateLimitTransportOf(t *testing.T, client *SecretClient) *rateLimitTransport {
+	t.Helper()
+	breaker, ok := client.HTTPClient.Transport.(*breakerTransport)
+	if !ok {
+		t.Fatalf("unexpected transport %T", client.HTTPClient.Transport)
+	}
+	retry, ok := breaker.next.(*retryTransport)
+	if !ok {
+		t.Fatalf("unexpected transport %T", breaker.next)
+	}
+	rateLimit, ok := retry.next.(*rateLimitTransport)
+	if !ok {
+		t.Fatalf("unexpected transport %T", retry.next)
+	}
+	return rateLimit
+}
+
+func TestCredentialsShareEndpointBucket(t *testing.T) {
+	parameters := config.SpcParameters{
+		DsmEndpoint: "https://shared-bucket.example.com",
+		AuthMethod:  config.AuthMethodAPIKey,
+		RateLimits: config.RateLimits{
+			EndpointRate: 10, EndpointBurst: 20,
+			CredentialRate: 5, CredentialBurst: 10,
+		},
+	}
+	first, second := parameters, parameters
+	first.ApiKey = "first"
+	second.ApiKey = "second"
+
+	firstClient, err := NewSecretClient(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondClient, err := NewSecretClient(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	firstBuckets := rateLimitTransportOf(t, firstClient).tokenBuckets(now)
+	secondBuckets := rateLimitTransportOf(t, secondClient).tokenBuckets(now)
+	if len(firstBuckets) != 2 || len(secondBuckets) != 2 {
+		t.Fatalf("got %d and %d buckets, want 2 each", len(firstBuckets), len(secondBuckets))
+	}
+	if firstBuckets[0] != secondBuckets[0] {
+		t.Error("credentials of the same endpoint got different endpoint buckets")
+	}
+	if firstBuckets[1] == secondBuckets[1] {
+		t.Error("different credentials got the same credential bucket")
+	}
+}
+
+func TestBucketRegistryKeepsRecentlyUsedBuckets(t *testing.T) {
+	registry := newBucketRegistry()
+	now := time.Now()
+	bucket := registry.get("a", 1, 1, now)
+
+	// A full bucket is kept while it was used recently, even when other
+	// keys are looked up.
+	registry.get("b", 1, 1, now.Add(bucketIdleTimeout/2))
+	if got := registry.get("a", 1, 1, now.Add(bucketIdleTimeout/2)); got != bucket {
+		t.Error("recently used bucket was dropped")
+	}
+
+	// Once unused for bucketIdleTimeout, it is dropped.
+	later := now.Add(bucketIdleTimeout * 3)
+	registry.get("b", 1, 1, later)
+	if _, ok := registry.buckets["a"]; ok {
+		t.Error("idle bucket was kept")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	// Each step reserves a token at offset after the bucket was created,
+	// unless cancel is set, in which case the last reserved token is
+	// returned.
+	type step struct {
+		offset    time.Duration
+		cancel    bool
+		wantDelay time.Duration
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []step
+	}{
+		{
+			name:  "burst is free",
+			rate:  1,
+			burst: 2,
+			steps: []step{{wantDelay: 0}, {wantDelay: 0}},
+		},
+		{
+			name:  "requests over the burst wait",
+			rate:  2,
+			burst: 1,
+			steps: []step{{wantDelay: 0}, {wantDelay: 500 * time.Millisecond}, {wantDelay: time.Second}},
+		},
+		{
+			name:  "tokens refill at rate",
+			rate:  10,
+			burst: 1,
+			steps: []step{{wantDelay: 0}, {offset: 100 * time.Millisecond, wantDelay: 0}},
+		},
+		{
+			name:  "refill is capped at burst",
+			rate:  10,
+			burst: 2,
+			steps: []step{
+				{offset: time.Hour, wantDelay: 0},
+				{offset: time.Hour, wantDelay: 0},
+				{offset: time.Hour, wantDelay: 100 * time.Millisecond},
+			},
+		},
+		{
+			name:  "cancel returns the token",
+			rate:  1,
+			burst: 1,
+			steps: []step{
+				{wantDelay: 0},
+				{wantDelay: time.Second},
+				{cancel: true},
+				{wantDelay: time.Second},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			bucket := newTokenBucket(tt.rate, tt.burst, start)
+			for i, s := range tt.steps {
+				if s.cancel {
+					bucket.cancel()
+					continue
+				}
+				delay := bucket.reserve(start.Add(s.offset))
+				if diff := delay - s.wantDelay; diff < -time.Millisecond || diff > time.Millisecond {
+					t.Errorf("step %d: reserve() = %v, want %v", i, delay, s.wantDelay)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketIdle(t *testing.T) {
+	start := time.Now()
+	bucket := newTokenBucket(1, 2, start)
+	if !bucket.idle(start) {
+		t.Error("new bucket is not idle")
+	}
+	bucket.reserve(start)
+	if bucket.idle(start) {
+		t.Error("bucket is idle right after a reservation")
+	}
+	if !bucket.idle(start.Add(time.Second)) {
+		t.Error("bucket is not idle once refilled")
+	}
+}
@@ -0,0 +1,206 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// scriptedTransport answers the attempts of a request in turn, repeating the
+// last answer. It records the body of each attempt.
+type scriptedTransport struct {
+	answers []answer
+	bodies  []string
+}
+
+type answer struct {
+	status     int
+	retryAfter string
+	err        error
+}
+
+func (t *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body string
+	if req.Body != nil {
+		data, _ := io.ReadAll(req.Body)
+		body = string(data)
+	}
+	t.bodies = append(t.bodies, body)
+	a := t.answers[min(len(t.bodies), len(t.answers))-1]
+	if a.err != nil {
+		return nil, a.err
+	}
+	resp := &http.Response{
+		StatusCode: a.status,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("")),
+	}
+	if a.retryAfter != "" {
+		resp.Header.Set("Retry-After", a.retryAfter)
+	}
+	return resp, nil
+}
+
+func TestRetryTransport(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	tlsErr := &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}
+	tests := []struct {
+		name         string
+		answers      []answer
+		wantStatus   int
+		wantErr      bool
+		wantAttempts int
+	}{
+		{
+			name:         "success",
+			answers:      []answer{{status: http.StatusOK}},
+			wantStatus:   http.StatusOK,
+			wantAttempts: 1,
+		},
+		{
+			name:         "server error",
+			answers:      []answer{{status: http.StatusServiceUnavailable, retryAfter: "0"}, {status: http.StatusOK}},
+			wantStatus:   http.StatusOK,
+			wantAttempts: 2,
+		},
+		{
+			name:         "too many requests",
+			answers:      []answer{{status: http.StatusTooManyRequests, retryAfter: "0"}, {status: http.StatusOK}},
+			wantStatus:   http.StatusOK,
+			wantAttempts: 2,
+		},
+		{
+			name:         "network error",
+			answers:      []answer{{err: dialErr}, {status: http.StatusOK}},
+			wantStatus:   http.StatusOK,
+			wantAttempts: 2,
+		},
+		{
+			name:         "retries exhausted",
+			answers:      []answer{{status: http.StatusBadGateway, retryAfter: "0"}},
+			wantStatus:   http.StatusBadGateway,
+			wantAttempts: maxRetries + 1,
+		},
+		{
+			name:         "not found",
+			answers:      []answer{{status: http.StatusNotFound}},
+			wantStatus:   http.StatusNotFound,
+			wantAttempts: 1,
+		},
+		{
+			name:         "not implemented",
+			answers:      []answer{{status: http.StatusNotImplemented}},
+			wantStatus:   http.StatusNotImplemented,
+			wantAttempts: 1,
+		},
+		{
+			name:         "TLS verification failure",
+			answers:      []answer{{err: tlsErr}},
+			wantErr:      true,
+			wantAttempts: 1,
+		},
+		{
+			name:         "Retry-After too long",
+			answers:      []answer{{status: http.StatusTooManyRequests, retryAfter: "3600"}},
+			wantStatus:   http.StatusTooManyRequests,
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &scriptedTransport{answers: tt.answers}
+			transport := &retryTransport{next: next}
+			req := httptest.NewRequest(http.MethodPost, "https://dsm.example.com/crypto/v1/keys/export", strings.NewReader("body"))
+			req.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader("body")), nil
+			}
+			resp, err := transport.RoundTrip(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RoundTrip() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if len(next.bodies) != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", len(next.bodies), tt.wantAttempts)
+			}
+			for i, body := range next.bodies {
+				if body != "body" {
+					t.Errorf("attempt %d: body = %q, want it replayed", i, body)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryTransportStopsAtDeadline(t *testing.T) {
+	next := &scriptedTransport{answers: []answer{{status: http.StatusServiceUnavailable, retryAfter: "5"}}}
+	transport := &retryTransport{next: next}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "https://dsm.example.com/sys/v1/version", nil).WithContext(ctx)
+
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("waited %v for a retry past the deadline", elapsed)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || len(next.bodies) != 1 {
+		t.Errorf("status = %d after %d attempts, want the first 503", resp.StatusCode, len(next.bodies))
+	}
+}
+
+func TestRetryTransportStopsWhenCanceled(t *testing.T) {
+	next := &scriptedTransport{answers: []answer{{status: http.StatusServiceUnavailable, retryAfter: "1"}}}
+	transport := &retryTransport{next: next}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req := httptest.NewRequest(http.MethodGet, "https://dsm.example.com/sys/v1/version", nil).WithContext(ctx)
+
+	if _, err := transport.RoundTrip(req); err != context.Canceled {
+		t.Errorf("RoundTrip() error = %v, want %v", err, context.Canceled)
+	}
+	if len(next.bodies) != 1 {
+		t.Errorf("attempts = %d, want 1", len(next.bodies))
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{value: ""},
+		{value: "0", wantOK: true},
+		{value: "120", want: 2 * time.Minute, wantOK: true},
+		{value: "-1"},
+		{value: "soon"},
+		{value: "Mon, 02 Jan 2006 15:04:05 GMT", wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+// sessionRefreshMargin is how long before its expiry a session is renewed,
+// so that requests in flight do not race the expiry.
+const sessionRefreshMargin = 30 * time.Second
+
+// session is a DSM bearer session. It is shared by all clients using the same
+// credential, so that mounts do not authenticate to DSM every time. The
+// current state is read without locking; mu only guards starting a refresh,
+// so that concurrent requests wait for a single authentication instead of
+// each authenticating, and no lock is held while DSM is called.
+type session struct {
+	state   atomic.Pointer[sessionState]
+	mu      sync.Mutex
+	refresh *sessionRefresh
+}
+
+type sessionState struct {
+	auth      sdkms.Authorization
+	expiresAt time.Time
+}
+
+// sessionRefresh is an authentication in flight. done is closed once auth or
+// err is set.
+type sessionRefresh struct {
+	done chan struct{}
+	auth sdkms.Authorization
+	err  error
+}
+
+// authorization returns the bearer token of the session, calling
+// authenticate first if there is no session yet or it is about to expire.
+func (s *session) authorization(
+	ctx context.Context,
+	authenticate func(context.Context) (*sdkms.AuthenticationResponse, error),
+) (sdkms.Authorization, error) {
+	for {
+		if state := s.state.Load(); state.valid(time.Now()) {
+			return state.auth, nil
+		}
+
+		s.mu.Lock()
+		refresh := s.refresh
+		if refresh == nil {
+			// Another request may have completed a refresh since the
+			// state was loaded.
+			if state := s.state.Load(); state.valid(time.Now()) {
+				s.mu.Unlock()
+				return state.auth, nil
+			}
+			refresh = &sessionRefresh{done: make(chan struct{})}
+			s.refresh = refresh
+			s.mu.Unlock()
+			return s.authenticate(ctx, refresh, authenticate)
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-refresh.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if refresh.err == nil {
+			return refresh.auth, nil
+		}
+		// The refresh failed because the request that started it was
+		// canceled or timed out. Requests that still have time try again.
+		if !errors.Is(refresh.err, context.Canceled) && !errors.Is(refresh.err, context.DeadlineExceeded) {
+			return nil, refresh.err
+		}
+	}
+}
+
+func (s *session) authenticate(
+	ctx context.Context,
+	refresh *sessionRefresh,
+	authenticate func(context.Context) (*sdkms.AuthenticationResponse, error),
+) (sdkms.Authorization, error) {
+	resp, err := authenticate(ctx)
+	if err == nil {
+		state := &sessionState{
+			auth:      sdkms.BearerToken(resp.AccessToken),
+			expiresAt: time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+		}
+		s.state.Store(state)
+		refresh.auth = state.auth
+	}
+	refresh.err = err
+
+	s.mu.Lock()
+	s.refresh = nil
+	s.mu.Unlock()
+	close(refresh.done)
+	return refresh.auth, refresh.err
+}
+
+// invalidate drops the session if it still uses auth, which DSM rejected.
+func (s *session) invalidate(auth sdkms.Authorization) {
+	if state := s.state.Load(); state != nil && state.auth == auth {
+		s.state.CompareAndSwap(state, nil)
+	}
+}
+
+func (s *session) expired(now time.Time) bool {
+	state := s.state.Load()
+	return state == nil || now.After(state.expiresAt)
+}
+
+// valid reports whether the session can still be used, i.e. it does not expire
+// within sessionRefreshMargin.
+func (s *sessionState) valid(now time.Time) bool {
+	return s != nil && now.Before(s.expiresAt.Add(-sessionRefreshMargin))
+}
+
+// sessionIdleTimeout is how long an expired session is kept after its last
+// use, so that requests that just looked it up still find it.
+const sessionIdleTimeout = time.Minute
+
+type storedSession struct {
+	session  *session
+	lastUsed time.Time
+}
+
+type sessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]*storedSession
+	lastSweep time.Time
+}
+
+var sessions = newSessionStore()
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]*storedSession)}
+}
+
+// get returns the session for a credential. Clients look it up for each
+// request rather than holding on to it. Expired sessions unused for
+// sessionIdleTimeout are dropped, so that short-lived credentials such as
+// service account tokens do not pile up.
+func (s *sessionStore) get(key string, now time.Time) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) >= sessionIdleTimeout {
+		s.lastSweep = now
+		for k, stored := range s.sessions {
+			if now.Sub(stored.lastUsed) >= sessionIdleTimeout && stored.session.expired(now) {
+				delete(s.sessions, k)
+			}
+		}
+	}
+	stored, ok := s.sessions[key]
+	if !ok {
+		stored = &storedSession{session: &session{}}
+		s.sessions[key] = stored
+	}
+	stored.lastUsed = now
+	return stored.session
+}
+
+// Key identifies the DSM endpoint, credential and connection settings of
+// parameters, i.e. everything a client is built from, without keeping the
+// credential itself around.
+func Key(parameters config.SpcParameters) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s\x00%q\x00%s\x00%s\x00", CredentialKey(parameters),
+		parameters.TLS.CACert, parameters.TLS.MinVersion, parameters.TLS.ServerName,
+		parameters.TLS.PinnedSHA256, parameters.Proxy.URL, parameters.Proxy.NoProxy)
+	hash.Write(parameters.Proxy.CACert)
+	fmt.Fprintf(hash, "\x00%d\x00%d", parameters.Timeouts.Connect, parameters.Timeouts.Read)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// CredentialKey identifies the DSM endpoint and credential of parameters
+// without keeping the credential itself around.
+func CredentialKey(parameters config.SpcParameters) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s\x00%s\x00", parameters.DsmEndpoint, parameters.AuthMethod,
+		parameters.ApiKey, parameters.AppID, parameters.JWT)
+	hash.Write(parameters.ClientCert)
+	return hex.EncodeToString(hash.Sum(nil))
+}
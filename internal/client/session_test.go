@@ -0,0 +1,203 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+func testAuthResponse(token string) *sdkms.AuthenticationResponse {
+	return &sdkms.AuthenticationResponse{AccessToken: token, ExpiresIn: 600}
+}
+
+func TestSessionSharesAuthentication(t *testing.T) {
+	var s session
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	authenticate := func(context.Context) (*sdkms.AuthenticationResponse, error) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return testAuthResponse("token"), nil
+	}
+
+	const requests = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	request := func() {
+		defer wg.Done()
+		auth, err := s.authorization(context.Background(), authenticate)
+		if err == nil && auth != sdkms.BearerToken("token") {
+			err = fmt.Errorf("authorization = %v, want the session token", auth)
+		}
+		errs <- err
+	}
+	wg.Add(requests)
+	go request()
+	<-started
+	for i := 1; i < requests; i++ {
+		go request()
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("authenticated %d times, want once", n)
+	}
+}
+
+func TestSessionRetriesCanceledAuthentication(t *testing.T) {
+	var s session
+	var calls atomic.Int32
+	started := make(chan struct{})
+	authenticate := func(ctx context.Context) (*sdkms.AuthenticationResponse, error) {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return testAuthResponse("token"), nil
+	}
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := s.authorization(leaderCtx, authenticate)
+		leaderErr <- err
+	}()
+	<-started
+	waiter := make(chan error, 1)
+	go func() {
+		_, err := s.authorization(context.Background(), authenticate)
+		waiter <- err
+	}()
+	cancel()
+
+	if err := <-leaderErr; err != context.Canceled {
+		t.Errorf("canceled request: error = %v, want %v", err, context.Canceled)
+	}
+	if err := <-waiter; err != nil {
+		t.Errorf("waiting request: error = %v, want it to authenticate itself", err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("authenticated %d times, want 2", n)
+	}
+}
+
+func TestSessionRefreshesBeforeExpiry(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		wantAuth  sdkms.Authorization
+	}{
+		{name: "valid", expiresIn: time.Hour, wantAuth: sdkms.BearerToken("old")},
+		{name: "about to expire", expiresIn: sessionRefreshMargin / 2, wantAuth: sdkms.BearerToken("new")},
+		{name: "expired", expiresIn: -time.Minute, wantAuth: sdkms.BearerToken("new")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s session
+			s.state.Store(&sessionState{auth: sdkms.BearerToken("old"), expiresAt: time.Now().Add(tt.expiresIn)})
+			auth, err := s.authorization(context.Background(), func(context.Context) (*sdkms.AuthenticationResponse, error) {
+				return testAuthResponse("new"), nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if auth != tt.wantAuth {
+				t.Errorf("authorization = %v, want %v", auth, tt.wantAuth)
+			}
+		})
+	}
+}
+
+func TestDoRetriesRejectedSession(t *testing.T) {
+	tests := []struct {
+		name         string
+		rejected     func(token string) bool
+		wantErr      bool
+		wantAuths    int32
+		wantRequests int32
+	}{
+		{
+			name:         "terminated session",
+			rejected:     func(token string) bool { return token == "Bearer token-1" },
+			wantAuths:    2,
+			wantRequests: 2,
+		},
+		{
+			name:         "rejected again",
+			rejected:     func(string) bool { return true },
+			wantErr:      true,
+			wantAuths:    2,
+			wantRequests: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var auths, requests atomic.Int32
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/sys/v1/session/auth" {
+					token := fmt.Sprintf("token-%d", auths.Add(1))
+					_ = json.NewEncoder(w).Encode(testAuthResponse(token))
+					return
+				}
+				requests.Add(1)
+				if tt.rejected(r.Header.Get("Authorization")) {
+					http.Error(w, "session expired", http.StatusUnauthorized)
+					return
+				}
+				sobject := sdkms.Sobject{Creator: sdkms.Principal{System: &struct{}{}}}
+				if err := json.NewEncoder(w).Encode(sobject); err != nil {
+					t.Error(err)
+				}
+			}))
+			defer server.Close()
+			client, err := NewSecretClient(config.SpcParameters{
+				DsmEndpoint: server.URL,
+				ApiKey:      "api-key",
+				TLS: config.TLSConfig{
+					CACert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = client.GetSobject(context.Background(), nil, *sdkms.SobjectByName("db-password"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetSobject() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if n := auths.Load(); n != tt.wantAuths {
+				t.Errorf("authenticated %d times, want %d", n, tt.wantAuths)
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("made %d requests, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// LastKnownGoodCache configures serving the secrets of a SecretProviderClass
+// from the node-local cache of their last successful mount while DSM is
+// unavailable.
+type LastKnownGoodCache struct {
+	Enabled bool
+	// SecretProviderClass is the name of the SecretProviderClass, which the
+	// driver does not pass to providers. Together with the pod namespace it
+	// keys the cache.
+	SecretProviderClass string
+	// MaxAge bounds how stale served secrets may be. It defaults to, and
+	// cannot exceed, the node-wide maximum.
+	MaxAge time.Duration
+}
+
+// parseLastKnownGoodCache reads the cache settings of a SecretProviderClass.
+func parseLastKnownGoodCache(params map[string]string) (LastKnownGoodCache, error) {
+	var cache LastKnownGoodCache
+	if enabled := params["lastKnownGoodCache"]; enabled != "" {
+		var err error
+		if cache.Enabled, err = strconv.ParseBool(enabled); err != nil {
+			return LastKnownGoodCache{}, fmt.Errorf("invalid `lastKnownGoodCache` %q, must be true or false", enabled)
+		}
+	}
+	cache.SecretProviderClass = params["secretProviderClassName"]
+	if maxAge := params["lastKnownGoodMaxAge"]; maxAge != "" {
+		var err error
+		if cache.MaxAge, err = time.ParseDuration(maxAge); err != nil {
+			return LastKnownGoodCache{}, fmt.Errorf("invalid `lastKnownGoodMaxAge` %q: %w", maxAge, err)
+		}
+	}
+	return cache, nil
+}
+
+// withDefaults applies the node-wide cache settings. The cache can only be
+// enabled for a SecretProviderClass if it is enabled on the node.
+func (c LastKnownGoodCache) withDefaults(flags FlagsConfig) (LastKnownGoodCache, error) {
+	if !c.Enabled {
+		return c, nil
+	}
+	if flags.CacheDir == "" {
+		return LastKnownGoodCache{}, errors.New("`lastKnownGoodCache` is set, but the cache is not enabled " +
+			"on this node with the --cache-dir flag")
+	}
+	if c.MaxAge == 0 || c.MaxAge > flags.CacheMaxAge {
+		c.MaxAge = flags.CacheMaxAge
+	}
+	return c, nil
+}
+
+func (c LastKnownGoodCache) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.SecretProviderClass == "" {
+		return errors.New("`lastKnownGoodCache` requires `secretProviderClassName`")
+	}
+	if c.MaxAge <= 0 {
+		return fmt.Errorf("invalid `lastKnownGoodMaxAge` %v, must be positive", c.MaxAge)
+	}
+	return nil
+}
@@ -10,9 +10,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
 )
 
 type FortanixConfig struct {
@@ -20,13 +27,18 @@ type FortanixConfig struct {
 	apikey   string
 }
 
-type Provider struct {
-	cache    map[string]string
-	versions map[string]string
-}
 type SpcParameters struct {
 	DsmEndpoint string
+	AuthMethod  AuthMethod
 	ApiKey      string
+	AppID       string
+	JWT         string
+	ClientCert  []byte
+	ClientKey   []byte
+	TLS         TLSConfig
+	Proxy       ProxyConfig
+	Timeouts    Timeouts
+	RateLimits  RateLimits
 	Secrets     []Secret
 }
 
@@ -35,14 +47,29 @@ func NewFortanixConfig() *FortanixConfig {
 }
 
 type Parameters struct {
-	DsmApiKey           string `json:"dsmApikey"`
-	DsmEndpoint         string `json:"dsmEndpoint"`
+	DsmApiKey           string     `json:"dsmApikey"`
+	DsmEndpoint         string     `json:"dsmEndpoint"`
+	AuthMethod          AuthMethod `json:"authMethod"`
+	AppID               string     `json:"appId"`
+	JWTAudience         string     `json:"jwtAudience"`
 	Secrets             []Secret
 	PodName             string
 	ServiceAccountName  string `json:"csi.storage.k8s.io/serviceAccount.name"`
 	Namespace           string `json:"csi.storage.k8s.io/pod.namespace"`
 	ServiceAccountToken string
 	UID                 string `json:"csi.storage.k8s.io/pod.uid"`
+	ClientCert          []byte `json:"-"`
+	ClientKey           []byte `json:"-"`
+	// TLS holds the TLS settings of the SecretProviderClass, completed with
+	// the node-wide defaults.
+	TLS TLSConfig `json:"-"`
+	// Proxy holds the proxy settings of the SecretProviderClass, completed
+	// with the node-wide defaults.
+	Proxy ProxyConfig `json:"-"`
+	// Timeouts and RateLimits are node-wide, given by flags.
+	Timeouts           Timeouts           `json:"-"`
+	RateLimits         RateLimits         `json:"-"`
+	LastKnownGoodCache LastKnownGoodCache `json:"-"`
 }
 type Config struct {
 	Parameters
@@ -50,9 +77,228 @@ type Config struct {
 	FilePermission os.FileMode
 }
 
+// ExportMode selects which part of a security object is mounted.
+type ExportMode string
+
+const (
+	// ExportValue mounts the exported value of the object. It requires the
+	// object to be exportable.
+	ExportValue ExportMode = "value"
+	// ExportPublicKey mounts the public half of an asymmetric object. It
+	// works for objects that are not exportable.
+	ExportPublicKey ExportMode = "publicKey"
+)
+
+// Encoding selects how the mounted material is serialized.
+type Encoding string
+
+const (
+	// EncodingRaw writes the bytes as returned by DSM, which is DER for keys
+	// and certificates.
+	EncodingRaw Encoding = "raw"
+	// EncodingDER is an alias of EncodingRaw.
+	EncodingDER    Encoding = "der"
+	EncodingBase64 Encoding = "base64"
+	EncodingHex    Encoding = "hex"
+	// EncodingPEM armors the material with a PEM header derived from the DSM
+	// object type. Only certificates and RSA/EC keys can be PEM encoded.
+	EncodingPEM Encoding = "pem"
+)
+
+// ObjectRef selects a security object either by name or by its key ID.
+type ObjectRef struct {
+	SecretName string `yaml:"secretName,omitempty"`
+	ObjectID   string `yaml:"objectId,omitempty"`
+}
+
+// Identifier returns the key ID if the object is selected by ID, and the
+// object name otherwise.
+func (r ObjectRef) Identifier() string {
+	if r.ObjectID != "" {
+		return r.ObjectID
+	}
+	return r.SecretName
+}
+
+func (r ObjectRef) selector() string {
+	if r.ObjectID != "" {
+		return "objectId " + r.ObjectID
+	}
+	return "secretName " + r.SecretName
+}
+
+func (r ObjectRef) validate() error {
+	if r.SecretName == "" && r.ObjectID == "" {
+		return errors.New("one of `secretName` or `objectId` is required")
+	}
+	if r.SecretName != "" && r.ObjectID != "" {
+		return errors.New("`secretName` and `objectId` are mutually exclusive")
+	}
+	if r.ObjectID != "" {
+		if _, err := uuid.Parse(r.ObjectID); err != nil {
+			return fmt.Errorf("invalid `objectId` %q: %w", r.ObjectID, err)
+		}
+	}
+	return nil
+}
+
+// File names written for a certificate with TLSFiles set.
+const (
+	TLSCertFileName = "tls.crt"
+	TLSKeyFileName  = "tls.key"
+	CACertFileName  = "ca.crt"
+)
+
+// Secret is a single entry of the `objects` list in a SecretProviderClass.
 type Secret struct {
-	SecretName     string
-	FilePermission os.FileMode
+	ObjectRef      `yaml:",inline"`
+	FileName       string      `yaml:"fileName,omitempty"`
+	FilePermission os.FileMode `yaml:"filePermission,omitempty"`
+	Export         ExportMode  `yaml:"export,omitempty"`
+	Encoding       Encoding    `yaml:"encoding,omitempty"`
+	// Chain lists the issuer certificates of a certificate object, starting
+	// with the one that signed it. They are appended to the leaf as a PEM
+	// bundle.
+	Chain []ObjectRef `yaml:"chain,omitempty"`
+	// TLSFiles mounts a certificate as a directory holding tls.crt, ca.crt
+	// and, if PrivateKey is set, tls.key.
+	TLSFiles   bool       `yaml:"tlsFiles,omitempty"`
+	PrivateKey *ObjectRef `yaml:"privateKey,omitempty"`
+	// JSONPath extracts fields of a secret holding a JSON document. Each
+	// field is written to its own file in the secret's directory.
+	JSONPath []JSONField `yaml:"jsonPath,omitempty"`
+}
+
+// FilePath returns the path, relative to the mount target, the secret is
+// written to. It defaults to the DSM object name or key ID. With TLSFiles or
+// JSONPath set it is the directory holding the individual files.
+func (s Secret) FilePath() string {
+	if s.FileName != "" {
+		return s.FileName
+	}
+	return s.Identifier()
+}
+
+// FilePaths returns the paths of all files written for the secret.
+func (s Secret) FilePaths() []string {
+	if len(s.JSONPath) > 0 {
+		filePaths := make([]string, 0, len(s.JSONPath))
+		for _, field := range s.JSONPath {
+			filePaths = append(filePaths, path.Join(s.FilePath(), field.fileName()))
+		}
+		return filePaths
+	}
+	if !s.TLSFiles {
+		return []string{s.FilePath()}
+	}
+	filePaths := []string{path.Join(s.FilePath(), TLSCertFileName)}
+	if len(s.Chain) > 0 {
+		filePaths = append(filePaths, path.Join(s.FilePath(), CACertFileName))
+	}
+	if s.PrivateKey != nil {
+		filePaths = append(filePaths, path.Join(s.FilePath(), TLSKeyFileName))
+	}
+	return filePaths
+}
+
+// ObjectVersionID identifies the secret in the object versions reported to
+// the driver, e.g. `secretName/db-password` or `objectId/<kid>/publicKey`.
+func (s Secret) ObjectVersionID() string {
+	id := "secretName/" + s.SecretName
+	if s.ObjectID != "" {
+		id = "objectId/" + s.ObjectID
+	}
+	if s.Export == ExportPublicKey {
+		id += "/publicKey"
+	}
+	return id
+}
+
+// ObjectRefs returns all security objects the secret is built from: the
+// object itself, followed by its Chain and PrivateKey.
+func (s Secret) ObjectRefs() []ObjectRef {
+	refs := append([]ObjectRef{s.ObjectRef}, s.Chain...)
+	if s.PrivateKey != nil {
+		refs = append(refs, *s.PrivateKey)
+	}
+	return refs
+}
+
+// IsCertificateBundle reports whether the secret is mounted together with
+// its issuers or private key, rather than as a single object.
+func (s Secret) IsCertificateBundle() bool {
+	return len(s.Chain) > 0 || s.TLSFiles
+}
+
+// selector uniquely identifies the security object a secret refers to, and
+// the part of it that is mounted.
+func (s Secret) selector() string {
+	selector := s.ObjectRef.selector()
+	if s.Export == ExportPublicKey {
+		selector += " (publicKey)"
+	}
+	return selector
+}
+
+func (s Secret) validate() error {
+	if err := s.ObjectRef.validate(); err != nil {
+		return err
+	}
+	if s.FilePermission&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid `filePermission` %#o", s.FilePermission)
+	}
+	switch s.Export {
+	case "", ExportValue, ExportPublicKey:
+	default:
+		return fmt.Errorf("invalid `export` %q, must be one of %q or %q",
+			s.Export, ExportValue, ExportPublicKey)
+	}
+	switch s.Encoding {
+	case "", EncodingRaw, EncodingDER, EncodingBase64, EncodingHex, EncodingPEM:
+	default:
+		return fmt.Errorf("invalid `encoding` %q, must be one of %q, %q, %q, %q or %q",
+			s.Encoding, EncodingRaw, EncodingDER, EncodingBase64, EncodingHex, EncodingPEM)
+	}
+
+	if s.PrivateKey != nil && !s.TLSFiles {
+		return errors.New("`privateKey` requires `tlsFiles`")
+	}
+	if s.IsCertificateBundle() {
+		if s.Export == ExportPublicKey {
+			return fmt.Errorf("`chain` and `tlsFiles` cannot be used with `export: %s`", ExportPublicKey)
+		}
+		if s.Encoding != "" && s.Encoding != EncodingPEM {
+			return fmt.Errorf("`chain` and `tlsFiles` require `encoding: %s`", EncodingPEM)
+		}
+	}
+	for i, issuer := range s.Chain {
+		if err := issuer.validate(); err != nil {
+			return fmt.Errorf("chain[%d]: %w", i, err)
+		}
+	}
+	if s.PrivateKey != nil {
+		if err := s.PrivateKey.validate(); err != nil {
+			return fmt.Errorf("privateKey: %w", err)
+		}
+	}
+
+	if len(s.JSONPath) > 0 {
+		if s.Export == ExportPublicKey || s.IsCertificateBundle() {
+			return errors.New("`jsonPath` cannot be combined with `export: publicKey`, `chain` or `tlsFiles`")
+		}
+		if s.Encoding == EncodingPEM {
+			return fmt.Errorf("`jsonPath` cannot be used with `encoding: %s`", EncodingPEM)
+		}
+	}
+	for i, field := range s.JSONPath {
+		if _, err := ParseJSONPath(field.Path); err != nil {
+			return fmt.Errorf("jsonPath[%d]: %w", i, err)
+		}
+		if err := validateFilePath(field.fileName()); err != nil {
+			return fmt.Errorf("jsonPath[%d]: invalid file name %q: %w", i, field.fileName(), err)
+		}
+	}
+	return nil
 }
 
 type FlagsConfig struct {
@@ -61,10 +307,39 @@ type FlagsConfig struct {
 	DsmApiKey   string
 	Version     bool
 	HealthAddr  string
+	// AllowNodeCredentials lets SecretProviderClasses without a
+	// nodePublishSecretRef use the node-wide FORTANIX_API_KEY, or client
+	// certificate for certificate authentication.
+	AllowNodeCredentials bool
+	ClientCertFile       string
+	ClientKeyFile        string
+	// ObjectVersionKeyFile holds a node-local key used to derive object
+	// versions as an HMAC. If empty, versions are derived from DSM metadata.
+	ObjectVersionKeyFile string
+	// Node-wide TLS settings for the DSM endpoint, which a
+	// SecretProviderClass can override. See TLSConfig.
+	DsmCAFile           string
+	DsmTLSMinVersion    string
+	DsmTLSServerName    string
+	DsmPinnedCertSHA256 string
+	// Node-wide proxy settings for the DSM endpoint, which a
+	// SecretProviderClass can override. See ProxyConfig.
+	DsmProxyURL    string
+	DsmNoProxy     string
+	DsmProxyCAFile string
+	Timeouts       Timeouts
+	RateLimits     RateLimits
+	// CacheDir enables the last-known-good cache, which SecretProviderClasses
+	// opt into. Entries are encrypted with the key in CacheKeyFile and served
+	// for up to CacheMaxAge.
+	CacheDir     string
+	CacheKeyFile string
+	CacheMaxAge  time.Duration
 }
 
 func Parse(
-	parametersStr, targetPath, permissionStr string,
+	parametersStr, secretsStr, targetPath, permissionStr string,
+	flags FlagsConfig,
 ) (Config, error) {
 	config := Config{
 		TargetPath: targetPath,
@@ -74,6 +349,39 @@ func Parse(
 	if err != nil {
 		return Config{}, err
 	}
+	var nodeCredentials bool
+	switch config.Parameters.AuthMethod {
+	case AuthMethodAPIKey:
+		config.Parameters.DsmApiKey, nodeCredentials, err = parseAPIKey(secretsStr, flags.AllowNodeCredentials)
+	case AuthMethodCertificate:
+		config.Parameters.ClientCert, config.Parameters.ClientKey, nodeCredentials, err =
+			parseClientCertificate(secretsStr, flags)
+	}
+	if err != nil {
+		return Config{}, err
+	}
+	if nodeCredentials {
+		if err := config.Parameters.restrictToNode(flags); err != nil {
+			return Config{}, err
+		}
+	}
+	if config.Parameters.DsmEndpoint == "" {
+		config.Parameters.DsmEndpoint = flags.DsmEndpoint
+	}
+	config.Parameters.TLS, err = config.Parameters.TLS.withDefaults(flags)
+	if err != nil {
+		return Config{}, err
+	}
+	config.Parameters.Proxy, err = config.Parameters.Proxy.withDefaults(flags)
+	if err != nil {
+		return Config{}, err
+	}
+	config.Parameters.Timeouts = flags.Timeouts
+	config.Parameters.RateLimits = flags.RateLimits
+	config.Parameters.LastKnownGoodCache, err = config.Parameters.LastKnownGoodCache.withDefaults(flags)
+	if err != nil {
+		return Config{}, err
+	}
 
 	if err := json.Unmarshal([]byte(permissionStr), &config.FilePermission); err != nil {
 		return Config{}, err
@@ -94,57 +402,167 @@ func parseParameters(parametersStr string) (Parameters, error) {
 	}
 
 	var parameters Parameters
-	parameters.DsmApiKey = os.Getenv("FORTANIX_API_KEY")
 	parameters.DsmEndpoint = params["dsmEndpoint"]
 	parameters.PodName = params["csi.storage.k8s.io/pod.name"]
 	parameters.UID = params["csi.storage.k8s.io/pod.uid"]
 	parameters.Namespace = params["csi.storage.k8s.io/pod.namespace"]
 	parameters.ServiceAccountName = params["csi.storage.k8s.io/serviceAccount.name"]
-	if parameters.DsmEndpoint == "" {
-		parameters.DsmEndpoint = os.Getenv("FORTANIX_DSM_ENDPOINT")
+	parameters.AuthMethod = AuthMethod(params["authMethod"])
+	if parameters.AuthMethod == "" {
+		parameters.AuthMethod = AuthMethodAPIKey
 	}
-	var secrets []Secret
-	secretStr := params["objects"]
-	secretEntries := strings.Split(secretStr, "- secretName: ")
-	for _, entry := range secretEntries {
-		secretName := strings.Trim(strings.TrimSpace(entry), "\"")
-		if secretName != "" {
-			secrets = append(secrets, Secret{SecretName: secretName})
+	parameters.TLS = parseTLSConfig(params)
+	parameters.Proxy = parseProxyConfig(params)
+	cache, err := parseLastKnownGoodCache(params)
+	if err != nil {
+		return Parameters{}, err
+	}
+	parameters.LastKnownGoodCache = cache
+	parameters.AppID = params["appId"]
+	parameters.JWTAudience = params["jwtAudience"]
+	if parameters.AuthMethod == AuthMethodJWT {
+		token, err := parseServiceAccountToken(params[serviceAccountTokensKey], parameters.JWTAudience)
+		if err != nil {
+			return Parameters{}, err
 		}
+		parameters.ServiceAccountToken = token
+	}
+	secrets, err := parseObjects(params["objects"])
+	if err != nil {
+		return Parameters{}, err
 	}
 	parameters.Secrets = secrets
 	return parameters, nil
 }
 
+// parseObjects decodes the `objects` parameter, which is a YAML (or JSON)
+// list of Secret entries. Unknown keys are rejected so that typos surface
+// as errors, including the offending line, instead of being ignored. For the
+// same reason, only a single YAML document is accepted.
+func parseObjects(objectsStr string) ([]Secret, error) {
+	var secrets []Secret
+	decoder := yaml.NewDecoder(strings.NewReader(objectsStr))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&secrets); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to parse `objects`: %w", err)
+	}
+	var next yaml.Node
+	if err := decoder.Decode(&next); !errors.Is(err, io.EOF) {
+		return nil, errors.New("failed to parse `objects`: it must be a single YAML document")
+	}
+	return secrets, nil
+}
+
 func (c *Config) validate() error {
 	// Some basic validation checks.
 	if c.TargetPath == "" {
 		return errors.New("missing target path field")
 	}
-	if c.Parameters.DsmApiKey == "" {
-		return errors.New("missing API key - must be set via FORTANIX_API_KEY environment variable")
+	if err := c.Parameters.validateCredentials(); err != nil {
+		return err
 	}
 	if c.Parameters.DsmEndpoint == "" {
 		return errors.New("missing DSM endpoint")
 	}
+	if err := c.Parameters.TLS.validate(); err != nil {
+		return err
+	}
+	if err := c.Parameters.Proxy.validate(); err != nil {
+		return err
+	}
+	// The server name would be sent to an HTTPS proxy as well, failing the
+	// handshake with it.
+	if c.Parameters.TLS.ServerName != "" && c.Parameters.Proxy.UsesTLS() {
+		return errors.New("`dsmTlsServerName` cannot be used with an HTTPS proxy")
+	}
+	if err := c.Parameters.Timeouts.validate(); err != nil {
+		return err
+	}
+	if err := c.Parameters.RateLimits.validate(); err != nil {
+		return err
+	}
+	if err := c.Parameters.LastKnownGoodCache.validate(); err != nil {
+		return err
+	}
 	if len(c.Parameters.Secrets) == 0 {
 		return errors.New("no secrets configured - the provider will not read any secret material")
 	}
 
 	objectNames := map[string]struct{}{}
 	conflicts := []string{}
-	for _, secret := range c.Parameters.Secrets {
-		if _, exists := objectNames[secret.SecretName]; exists {
-			conflicts = append(conflicts, secret.SecretName)
+	for i, secret := range c.Parameters.Secrets {
+		if err := secret.validate(); err != nil {
+			return fmt.Errorf("objects[%d]: %w", i, err)
 		}
 
-		objectNames[secret.SecretName] = struct{}{}
+		selector := secret.selector()
+		if _, exists := objectNames[selector]; exists {
+			conflicts = append(conflicts, selector)
+		}
+
+		objectNames[selector] = struct{}{}
 	}
 
 	if len(conflicts) > 0 {
-		return fmt.Errorf("each `secretName` within a SecretProviderClass must be unique, "+
+		return fmt.Errorf("each `secretName` and `objectId` within a SecretProviderClass must be unique, "+
 			"but the following keys were duplicated: %s", strings.Join(conflicts, ", "))
 	}
 
+	return validateFilePaths(c.Parameters.Secrets)
+}
+
+// validateFilePaths checks that every secret is written to a distinct path
+// inside the mount target, and that no file is also used as a directory.
+func validateFilePaths(secrets []Secret) error {
+	filePaths := map[string]struct{}{}
+	conflicts := []string{}
+	for i, secret := range secrets {
+		if err := validateFilePath(secret.FilePath()); err != nil {
+			return fmt.Errorf("objects[%d]: invalid file path %q: %w", i, secret.FilePath(), err)
+		}
+		for _, filePath := range secret.FilePaths() {
+			if _, exists := filePaths[filePath]; exists {
+				conflicts = append(conflicts, filePath)
+			}
+			filePaths[filePath] = struct{}{}
+		}
+	}
+
+	for filePath := range filePaths {
+		for dir := path.Dir(filePath); dir != "."; dir = path.Dir(dir) {
+			if _, exists := filePaths[dir]; exists {
+				conflicts = append(conflicts, dir)
+			}
+		}
+	}
+
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("each file path within a SecretProviderClass must be unique and must not "+
+			"be the parent directory of another, but the following paths collided: %s",
+			strings.Join(conflicts, ", "))
+	}
+
+	return nil
+}
+
+func validateFilePath(filePath string) error {
+	if filePath == "" {
+		return errors.New("path is empty")
+	}
+	if path.IsAbs(filePath) {
+		return errors.New("path must be relative")
+	}
+	for _, elem := range strings.Split(filePath, "/") {
+		if elem == "." || elem == ".." {
+			return fmt.Errorf("path must not contain '%s'", elem)
+		}
+	}
+	if path.Clean(filePath) != filePath {
+		return errors.New("path must be in canonical form")
+	}
 	return nil
 }
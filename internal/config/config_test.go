@@ -0,0 +1,251 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testObjectID = "1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+
+func TestParseObjects(t *testing.T) {
+	tests := []struct {
+		name    string
+		objects string
+		want    []Secret
+		wantErr string
+	}{
+		{name: "empty", objects: "", want: nil},
+		{
+			name: "yaml",
+			objects: `
+- secretName: db-password
+  fileName: db/password
+- objectId: ` + testObjectID + `
+  export: publicKey
+  encoding: pem
+`,
+			want: []Secret{
+				{ObjectRef: ObjectRef{SecretName: "db-password"}, FileName: "db/password"},
+				{ObjectRef: ObjectRef{ObjectID: testObjectID}, Export: ExportPublicKey, Encoding: EncodingPEM},
+			},
+		},
+		{
+			name:    "json",
+			objects: `[{"secretName": "a", "jsonPath": [{"path": "$.b"}]}]`,
+			want:    []Secret{{ObjectRef: ObjectRef{SecretName: "a"}, JSONPath: []JSONField{{Path: "$.b"}}}},
+		},
+		{name: "unknown key", objects: "- secretName: a\n  filename: b\n", wantErr: "line 2"},
+		{name: "not a list", objects: "secretName: a\n", wantErr: "failed to parse"},
+		{
+			name:    "several documents",
+			objects: "- secretName: a\n---\n- secretName: b\n",
+			wantErr: "single YAML document",
+		},
+		{
+			name:    "invalid second document",
+			objects: "- secretName: a\n---\n- [\n",
+			wantErr: "single YAML document",
+		},
+		{
+			name:    "document end marker",
+			objects: "---\n- secretName: a\n...\n",
+			want:    []Secret{{ObjectRef: ObjectRef{SecretName: "a"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseObjects(tt.objects)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseObjects() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseObjects() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseObjects() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  Secret
+		wantErr string
+	}{
+		{name: "secret name", secret: Secret{ObjectRef: ObjectRef{SecretName: "a"}}},
+		{name: "object id", secret: Secret{ObjectRef: ObjectRef{ObjectID: testObjectID}}},
+		{name: "no object", secret: Secret{}, wantErr: "is required"},
+		{
+			name:    "name and id",
+			secret:  Secret{ObjectRef: ObjectRef{SecretName: "a", ObjectID: testObjectID}},
+			wantErr: "mutually exclusive",
+		},
+		{name: "invalid id", secret: Secret{ObjectRef: ObjectRef{ObjectID: "a"}}, wantErr: "invalid `objectId`"},
+		{
+			name:    "invalid permission",
+			secret:  Secret{ObjectRef: ObjectRef{SecretName: "a"}, FilePermission: 0o1777},
+			wantErr: "invalid `filePermission`",
+		},
+		{
+			name:    "invalid export",
+			secret:  Secret{ObjectRef: ObjectRef{SecretName: "a"}, Export: "all"},
+			wantErr: "invalid `export`",
+		},
+		{
+			name:    "invalid encoding",
+			secret:  Secret{ObjectRef: ObjectRef{SecretName: "a"}, Encoding: "utf16"},
+			wantErr: "invalid `encoding`",
+		},
+		{
+			name: "tls files",
+			secret: Secret{
+				ObjectRef:  ObjectRef{SecretName: "cert"},
+				TLSFiles:   true,
+				Chain:      []ObjectRef{{SecretName: "ca"}},
+				PrivateKey: &ObjectRef{SecretName: "key"},
+			},
+		},
+		{
+			name:    "private key without tls files",
+			secret:  Secret{ObjectRef: ObjectRef{SecretName: "cert"}, PrivateKey: &ObjectRef{SecretName: "key"}},
+			wantErr: "requires `tlsFiles`",
+		},
+		{
+			name: "chain with public key",
+			secret: Secret{
+				ObjectRef: ObjectRef{SecretName: "cert"},
+				Export:    ExportPublicKey,
+				Chain:     []ObjectRef{{SecretName: "ca"}},
+			},
+			wantErr: "cannot be used with `export: publicKey`",
+		},
+		{
+			name: "chain with base64",
+			secret: Secret{
+				ObjectRef: ObjectRef{SecretName: "cert"},
+				Encoding:  EncodingBase64,
+				Chain:     []ObjectRef{{SecretName: "ca"}},
+			},
+			wantErr: "require `encoding: pem`",
+		},
+		{
+			name:    "invalid chain",
+			secret:  Secret{ObjectRef: ObjectRef{SecretName: "cert"}, Chain: []ObjectRef{{}}},
+			wantErr: "chain[0]",
+		},
+		{
+			name:   "json path",
+			secret: Secret{ObjectRef: ObjectRef{SecretName: "a"}, JSONPath: []JSONField{{Path: "$.b"}}},
+		},
+		{
+			name: "json path with pem",
+			secret: Secret{
+				ObjectRef: ObjectRef{SecretName: "a"},
+				Encoding:  EncodingPEM,
+				JSONPath:  []JSONField{{Path: "$.b"}},
+			},
+			wantErr: "cannot be used with `encoding: pem`",
+		},
+		{
+			name:    "invalid json path",
+			secret:  Secret{ObjectRef: ObjectRef{SecretName: "a"}, JSONPath: []JSONField{{Path: "a..b"}}},
+			wantErr: "jsonPath[0]",
+		},
+		{
+			name:    "json path file name dot",
+			secret:  Secret{ObjectRef: ObjectRef{SecretName: "a"}, JSONPath: []JSONField{{Path: "$['.']"}}},
+			wantErr: "must not contain '.'",
+		},
+		{
+			name:    "json path file name dot dot",
+			secret:  Secret{ObjectRef: ObjectRef{SecretName: "a"}, JSONPath: []JSONField{{Path: "$.b", FileName: ".."}}},
+			wantErr: "must not contain '..'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.secret.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validate() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateFilePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{path: "password"},
+		{path: "db/password"},
+		{path: "", wantErr: true},
+		{path: "/etc/passwd", wantErr: true},
+		{path: ".", wantErr: true},
+		{path: "..", wantErr: true},
+		{path: "a/./b", wantErr: true},
+		{path: "a/../b", wantErr: true},
+		{path: "../a", wantErr: true},
+		{path: "a//b", wantErr: true},
+		{path: "a/", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateFilePath(tt.path); (err != nil) != tt.wantErr {
+			t.Errorf("validateFilePath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateFilePaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets []Secret
+		wantErr bool
+	}{
+		{
+			name:    "distinct",
+			secrets: []Secret{{ObjectRef: ObjectRef{SecretName: "a"}}, {ObjectRef: ObjectRef{SecretName: "b"}}},
+		},
+		{
+			name: "duplicate",
+			secrets: []Secret{
+				{ObjectRef: ObjectRef{SecretName: "a"}},
+				{ObjectRef: ObjectRef{SecretName: "b"}, FileName: "a"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "file is a directory of another",
+			secrets: []Secret{
+				{ObjectRef: ObjectRef{SecretName: "a"}},
+				{ObjectRef: ObjectRef{SecretName: "b"}, FileName: "a/b"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateFilePaths(tt.secrets); (err != nil) != tt.wantErr {
+				t.Errorf("validateFilePaths() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// AuthMethod selects how the provider authenticates to DSM.
+type AuthMethod string
+
+const (
+	// AuthMethodAPIKey authenticates with the API key of a DSM app.
+	AuthMethodAPIKey AuthMethod = "apiKey"
+	// AuthMethodJWT authenticates as a DSM app configured for JWT
+	// authentication, presenting the pod's service account token.
+	AuthMethodJWT AuthMethod = "jwt"
+	// AuthMethodCertificate authenticates as a DSM app configured for
+	// certificate authentication, presenting a client certificate over mutual
+	// TLS.
+	AuthMethodCertificate AuthMethod = "certificate"
+)
+
+// serviceAccountTokensKey is the parameter the driver passes the pod's
+// service account tokens in, if tokenRequests are configured on the CSIDriver.
+const serviceAccountTokensKey = "csi.storage.k8s.io/serviceAccount.tokens"
+
+type serviceAccountToken struct {
+	Token               string `json:"token"`
+	ExpirationTimestamp string `json:"expirationTimestamp"`
+}
+
+// Keys of the nodePublishSecretRef secret that hold DSM credentials. Either
+// an API key, or the app ID and secret it is made of, can be given. For
+// certificate authentication the secret holds the client certificate and key,
+// like a secret of type kubernetes.io/tls.
+const (
+	APIKeySecretKey     = "api-key"
+	AppIDSecretKey      = "app-id"
+	AppSecretSecretKey  = "app-secret"
+	ClientCertSecretKey = "tls.crt"
+	ClientKeySecretKey  = "tls.key"
+)
+
+func parseNodePublishSecret(secretsStr string) (map[string]string, error) {
+	var secrets map[string]string
+	if secretsStr != "" {
+		if err := json.Unmarshal([]byte(secretsStr), &secrets); err != nil {
+			return nil, errors.New("failed to parse the nodePublishSecretRef secret")
+		}
+	}
+	return secrets, nil
+}
+
+// parseAPIKey returns the API key of the SecretProviderClass from the
+// contents of its nodePublishSecretRef secret. Without one, the node-wide
+// FORTANIX_API_KEY is used if allowNodeCredentials is set, which the returned
+// bool reports.
+func parseAPIKey(secretsStr string, allowNodeCredentials bool) (string, bool, error) {
+	secrets, err := parseNodePublishSecret(secretsStr)
+	if err != nil {
+		return "", false, err
+	}
+
+	apiKey := strings.TrimSpace(secrets[APIKeySecretKey])
+	appID := strings.TrimSpace(secrets[AppIDSecretKey])
+	appSecret := strings.TrimSpace(secrets[AppSecretSecretKey])
+	switch {
+	case apiKey != "":
+		if appID != "" || appSecret != "" {
+			return "", false, errors.New("the nodePublishSecretRef secret must hold either `" + APIKeySecretKey +
+				"` or `" + AppIDSecretKey + "` and `" + AppSecretSecretKey + "`, not both")
+		}
+		return apiKey, false, nil
+	case appID != "" || appSecret != "":
+		if appID == "" || appSecret == "" {
+			return "", false, errors.New("the nodePublishSecretRef secret must hold both `" + AppIDSecretKey +
+				"` and `" + AppSecretSecretKey + "`")
+		}
+		return base64.StdEncoding.EncodeToString([]byte(appID + ":" + appSecret)), false, nil
+	case allowNodeCredentials:
+		return os.Getenv("FORTANIX_API_KEY"), true, nil
+	}
+	return "", false, nil
+}
+
+// parseClientCertificate returns the PEM encoded client certificate and key
+// of the SecretProviderClass from its nodePublishSecretRef secret. Without
+// one, the node-wide files given by flags are used if node credentials are
+// allowed, which the returned bool reports.
+func parseClientCertificate(secretsStr string, flags FlagsConfig) ([]byte, []byte, bool, error) {
+	secrets, err := parseNodePublishSecret(secretsStr)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	cert := secrets[ClientCertSecretKey]
+	key := secrets[ClientKeySecretKey]
+	switch {
+	case cert != "" || key != "":
+		if cert == "" || key == "" {
+			return nil, nil, false, errors.New("the nodePublishSecretRef secret must hold both `" +
+				ClientCertSecretKey + "` and `" + ClientKeySecretKey + "`")
+		}
+		return []byte(cert), []byte(key), false, nil
+	case flags.AllowNodeCredentials && flags.ClientCertFile != "":
+		certPEM, err := os.ReadFile(flags.ClientCertFile)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("failed to read client certificate: %w", err)
+		}
+		keyPEM, err := os.ReadFile(flags.ClientKeyFile)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("failed to read client key: %w", err)
+		}
+		return certPEM, keyPEM, true, nil
+	}
+	return nil, nil, false, nil
+}
+
+// restrictToNode checks that parameters using node credentials only send them
+// to the node's DSM endpoint, over the node's TLS and proxy settings, so that
+// a SecretProviderClass cannot direct them to a server of its choosing.
+func (p Parameters) restrictToNode(flags FlagsConfig) error {
+	if p.DsmEndpoint != "" && strings.TrimSuffix(p.DsmEndpoint, "/") != strings.TrimSuffix(flags.DsmEndpoint, "/") {
+		return fmt.Errorf("node credentials are only sent to the node's DSM endpoint %q, "+
+			"a nodePublishSecretRef must be set to use `dsmEndpoint` %q", flags.DsmEndpoint, p.DsmEndpoint)
+	}
+	if !p.TLS.IsZero() || !p.Proxy.IsZero() {
+		return errors.New("the TLS and proxy parameters cannot be set when using node credentials, " +
+			"a nodePublishSecretRef must be set to override them")
+	}
+	return nil
+}
+
+// parseServiceAccountToken selects the token for audience from the tokens
+// the driver passes. If no audience is configured, exactly one token must
+// have been requested.
+func parseServiceAccountToken(tokensStr, audience string) (string, error) {
+	if tokensStr == "" {
+		return "", errors.New("no service account token was passed, " +
+			"`tokenRequests` must be configured on the CSIDriver")
+	}
+	var tokens map[string]serviceAccountToken
+	if err := json.Unmarshal([]byte(tokensStr), &tokens); err != nil {
+		return "", errors.New("failed to parse the service account tokens")
+	}
+
+	if audience != "" {
+		token, ok := tokens[audience]
+		if !ok {
+			return "", fmt.Errorf("no service account token was passed for audience %q", audience)
+		}
+		return token.Token, nil
+	}
+	if len(tokens) != 1 {
+		return "", fmt.Errorf("%d service account tokens were passed, `jwtAudience` must select one", len(tokens))
+	}
+	for _, token := range tokens {
+		return token.Token, nil
+	}
+	return "", nil
+}
+
+func (p Parameters) validateCredentials() error {
+	switch p.AuthMethod {
+	case AuthMethodAPIKey:
+		if p.DsmApiKey == "" {
+			return errors.New("missing API key - must be set via the nodePublishSecretRef secret, " +
+				"or the FORTANIX_API_KEY environment variable if node credentials are allowed")
+		}
+	case AuthMethodJWT:
+		if _, err := uuid.Parse(p.AppID); err != nil {
+			return fmt.Errorf("`appId` must be the UUID of a DSM app with JWT authentication: %w", err)
+		}
+		if p.ServiceAccountToken == "" {
+			return errors.New("missing service account token")
+		}
+	case AuthMethodCertificate:
+		if _, err := uuid.Parse(p.AppID); err != nil {
+			return fmt.Errorf("`appId` must be the UUID of a DSM app with certificate authentication: %w", err)
+		}
+		if len(p.ClientCert) == 0 || len(p.ClientKey) == 0 {
+			return errors.New("missing client certificate - must be set via the nodePublishSecretRef secret, " +
+				"or the --client-cert-file and --client-key-file flags if node credentials are allowed")
+		}
+	default:
+		return fmt.Errorf("invalid `authMethod` %q, must be one of %q, %q or %q",
+			p.AuthMethod, AuthMethodAPIKey, AuthMethodJWT, AuthMethodCertificate)
+	}
+	return nil
+}
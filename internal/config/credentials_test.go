@@ -0,0 +1,239 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testNodeEndpoint = "https://amer.smartkey.io"
+	testAppID        = "9a6b5c8e-3f1d-4e2a-8b7c-1d2e3f4a5b6c"
+)
+
+func parseForTest(t *testing.T, params map[string]string, secrets map[string]string, flags FlagsConfig) (Config, error) {
+	t.Helper()
+	if _, ok := params["objects"]; !ok {
+		params["objects"] = "- secretName: a"
+	}
+	paramsStr, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secretsStr []byte
+	if secrets != nil {
+		if secretsStr, err = json.Marshal(secrets); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return Parse(string(paramsStr), string(secretsStr), "/target", "420", flags)
+}
+
+func TestNodeAPIKeyRestrictedToNodeEndpoint(t *testing.T) {
+	t.Setenv("FORTANIX_API_KEY", "node-key")
+	flags := FlagsConfig{DsmEndpoint: testNodeEndpoint, AllowNodeCredentials: true}
+	podSecret := map[string]string{APIKeySecretKey: "pod-key"}
+
+	tests := []struct {
+		name         string
+		params       map[string]string
+		secrets      map[string]string
+		wantErr      string
+		wantKey      string
+		wantEndpoint string
+	}{
+		{
+			name:         "node endpoint",
+			params:       map[string]string{"dsmEndpoint": testNodeEndpoint},
+			wantKey:      "node-key",
+			wantEndpoint: testNodeEndpoint,
+		},
+		{
+			name:         "node endpoint with trailing slash",
+			params:       map[string]string{"dsmEndpoint": testNodeEndpoint + "/"},
+			wantKey:      "node-key",
+			wantEndpoint: testNodeEndpoint + "/",
+		},
+		{
+			name:         "no endpoint",
+			params:       map[string]string{},
+			wantKey:      "node-key",
+			wantEndpoint: testNodeEndpoint,
+		},
+		{
+			name:    "other endpoint",
+			params:  map[string]string{"dsmEndpoint": "https://attacker.example.com"},
+			wantErr: "only sent to the node's DSM endpoint",
+		},
+		{
+			name:    "CA override",
+			params:  map[string]string{"dsmCaCert": "-----BEGIN CERTIFICATE-----"},
+			wantErr: "cannot be set when using node credentials",
+		},
+		{
+			name:    "server name override",
+			params:  map[string]string{"dsmTlsServerName": "attacker.example.com"},
+			wantErr: "cannot be set when using node credentials",
+		},
+		{
+			name:    "proxy override",
+			params:  map[string]string{"dsmProxyUrl": "http://attacker.example.com:3128"},
+			wantErr: "cannot be set when using node credentials",
+		},
+		{
+			name:         "own credential to other endpoint",
+			params:       map[string]string{"dsmEndpoint": "https://eu.smartkey.io", "dsmProxyUrl": "http://proxy:3128"},
+			secrets:      podSecret,
+			wantKey:      "pod-key",
+			wantEndpoint: "https://eu.smartkey.io",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseForTest(t, tt.params, tt.secrets, flags)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Parse() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if cfg.Parameters.DsmApiKey != tt.wantKey {
+				t.Errorf("API key = %q, want %q", cfg.Parameters.DsmApiKey, tt.wantKey)
+			}
+			if cfg.Parameters.DsmEndpoint != tt.wantEndpoint {
+				t.Errorf("endpoint = %q, want %q", cfg.Parameters.DsmEndpoint, tt.wantEndpoint)
+			}
+		})
+	}
+}
+
+func TestNodeCredentialsDisallowed(t *testing.T) {
+	t.Setenv("FORTANIX_API_KEY", "node-key")
+	flags := FlagsConfig{DsmEndpoint: testNodeEndpoint}
+	_, err := parseForTest(t, map[string]string{}, nil, flags)
+	if err == nil || !strings.Contains(err.Error(), "missing API key") {
+		t.Fatalf("Parse() error = %v, want a missing API key", err)
+	}
+}
+
+func TestNodeClientCertificateRestrictedToNodeEndpoint(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, []byte("cert"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, []byte("key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	flags := FlagsConfig{
+		DsmEndpoint:          testNodeEndpoint,
+		AllowNodeCredentials: true,
+		ClientCertFile:       certFile,
+		ClientKeyFile:        keyFile,
+	}
+	params := func(endpoint string) map[string]string {
+		return map[string]string{
+			"dsmEndpoint": endpoint,
+			"authMethod":  string(AuthMethodCertificate),
+			"appId":       testAppID,
+		}
+	}
+
+	cfg, err := parseForTest(t, params(testNodeEndpoint), nil, flags)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if string(cfg.Parameters.ClientCert) != "cert" || string(cfg.Parameters.ClientKey) != "key" {
+		t.Error("node client certificate was not used")
+	}
+
+	_, err = parseForTest(t, params("https://attacker.example.com"), nil, flags)
+	if err == nil || !strings.Contains(err.Error(), "only sent to the node's DSM endpoint") {
+		t.Fatalf("Parse() error = %v, want the endpoint to be rejected", err)
+	}
+}
+
+func TestParseAPIKey(t *testing.T) {
+	t.Setenv("FORTANIX_API_KEY", "node-key")
+	secret := func(entries map[string]string) string {
+		encoded, err := json.Marshal(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(encoded)
+	}
+	// The base64 encoding of "<testAppID>:app-secret".
+	appKey := "OWE2YjVjOGUtM2YxZC00ZTJhLThiN2MtMWQyZTNmNGE1YjZjOmFwcC1zZWNyZXQ="
+	tests := []struct {
+		name                 string
+		secrets              string
+		allowNodeCredentials bool
+		wantKey              string
+		wantNode             bool
+		wantErr              bool
+	}{
+		{
+			name:    "API key",
+			secrets: secret(map[string]string{APIKeySecretKey: " pod-key\n"}),
+			wantKey: "pod-key",
+		},
+		{
+			name:    "app ID and secret",
+			secrets: secret(map[string]string{AppIDSecretKey: testAppID, AppSecretSecretKey: "app-secret"}),
+			wantKey: appKey,
+		},
+		{
+			name:    "API key and app ID",
+			secrets: secret(map[string]string{APIKeySecretKey: "pod-key", AppIDSecretKey: testAppID}),
+			wantErr: true,
+		},
+		{
+			name:    "app ID without secret",
+			secrets: secret(map[string]string{AppIDSecretKey: testAppID}),
+			wantErr: true,
+		},
+		{
+			name:    "invalid secret",
+			secrets: `{"` + APIKeySecretKey + `": `,
+			wantErr: true,
+		},
+		{
+			name:                 "node key",
+			allowNodeCredentials: true,
+			wantKey:              "node-key",
+			wantNode:             true,
+		},
+		{
+			name: "node key disallowed",
+		},
+		{
+			name:                 "pod key preferred",
+			secrets:              secret(map[string]string{APIKeySecretKey: "pod-key"}),
+			allowNodeCredentials: true,
+			wantKey:              "pod-key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, node, err := parseAPIKey(tt.secrets, tt.allowNodeCredentials)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAPIKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if key != tt.wantKey || node != tt.wantNode {
+				t.Errorf("parseAPIKey() = %q, %v, want %q, %v", key, node, tt.wantKey, tt.wantNode)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSONField selects a single field of a secret holding a JSON document and
+// writes it to its own file.
+type JSONField struct {
+	// Path is a JSON path such as `$.db.username` or `hosts[0]`. The leading
+	// `$` is optional, and keys containing dots can be quoted: `$['a.b']`.
+	Path string `yaml:"path"`
+	// FileName is relative to the secret's directory and defaults to the last
+	// element of Path.
+	FileName string `yaml:"fileName,omitempty"`
+}
+
+// JSONPathElem is a single step of a parsed JSON path. It is an array index
+// if IsIndex is set, and an object key otherwise.
+type JSONPathElem struct {
+	Key     string
+	Index   int
+	IsIndex bool
+}
+
+func (e JSONPathElem) String() string {
+	if e.IsIndex {
+		return strconv.Itoa(e.Index)
+	}
+	return e.Key
+}
+
+// fileName returns the name of the file the field is written to.
+func (f JSONField) fileName() string {
+	if f.FileName != "" {
+		return f.FileName
+	}
+	elems, err := ParseJSONPath(f.Path)
+	if err != nil || len(elems) == 0 {
+		return ""
+	}
+	return elems[len(elems)-1].String()
+}
+
+// ParseJSONPath splits a JSON path into its elements.
+func ParseJSONPath(jsonPath string) ([]JSONPathElem, error) {
+	rest := strings.TrimPrefix(jsonPath, "$")
+	if rest != "" && rest[0] != '.' && rest[0] != '[' {
+		rest = "." + rest
+	}
+
+	var elems []JSONPathElem
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid JSON path %q: empty key", jsonPath)
+			}
+			elems = append(elems, JSONPathElem{Key: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSON path %q: unterminated '['", jsonPath)
+			}
+			elem, err := parseJSONPathBracket(rest[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid JSON path %q: %w", jsonPath, err)
+			}
+			elems = append(elems, elem)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid JSON path %q: unexpected %q", jsonPath, rest[0])
+		}
+	}
+	if len(elems) == 0 {
+		return nil, fmt.Errorf("invalid JSON path %q: no elements", jsonPath)
+	}
+	return elems, nil
+}
+
+func parseJSONPathBracket(s string) (JSONPathElem, error) {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return JSONPathElem{Key: s[1 : len(s)-1]}, nil
+	}
+	index, err := strconv.Atoi(s)
+	if err != nil || index < 0 {
+		return JSONPathElem{}, errors.New("array index must be a non-negative integer")
+	}
+	return JSONPathElem{Index: index, IsIndex: true}, nil
+}
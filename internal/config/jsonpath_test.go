@@ -0,0 +1,64 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []JSONPathElem
+		wantErr bool
+	}{
+		{path: "$.db.username", want: []JSONPathElem{{Key: "db"}, {Key: "username"}}},
+		{path: "db.username", want: []JSONPathElem{{Key: "db"}, {Key: "username"}}},
+		{path: "username", want: []JSONPathElem{{Key: "username"}}},
+		{path: "hosts[0]", want: []JSONPathElem{{Key: "hosts"}, {Index: 0, IsIndex: true}}},
+		{path: "$[2].name", want: []JSONPathElem{{Index: 2, IsIndex: true}, {Key: "name"}}},
+		{path: "$['a.b']", want: []JSONPathElem{{Key: "a.b"}}},
+		{path: `$["a.b"].c`, want: []JSONPathElem{{Key: "a.b"}, {Key: "c"}}},
+		{path: "", wantErr: true},
+		{path: "$", wantErr: true},
+		{path: "a..b", wantErr: true},
+		{path: "a.", wantErr: true},
+		{path: "a[0", wantErr: true},
+		{path: "a[-1]", wantErr: true},
+		{path: "a[x]", wantErr: true},
+		{path: "a[0]b", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := ParseJSONPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseJSONPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseJSONPath(%q) = %+v, want %+v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONFieldFileName(t *testing.T) {
+	tests := []struct {
+		field JSONField
+		want  string
+	}{
+		{field: JSONField{Path: "$.db.username"}, want: "username"},
+		{field: JSONField{Path: "hosts[1]"}, want: "1"},
+		{field: JSONField{Path: "$.db.username", FileName: "user"}, want: "user"},
+		{field: JSONField{Path: "a..b"}, want: ""},
+	}
+	for _, tt := range tests {
+		if got := tt.field.fileName(); got != tt.want {
+			t.Errorf("%+v.fileName() = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
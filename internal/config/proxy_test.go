@@ -0,0 +1,68 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProxyTLSSettings(t *testing.T) {
+	podSecret := map[string]string{APIKeySecretKey: "pod-key"}
+	tests := []struct {
+		name    string
+		params  map[string]string
+		wantErr string
+	}{
+		{
+			name:   "server name with http proxy",
+			params: map[string]string{"dsmTlsServerName": "dsm.internal", "dsmProxyUrl": "http://proxy:3128"},
+		},
+		{
+			name:    "server name with https proxy",
+			params:  map[string]string{"dsmTlsServerName": "dsm.internal", "dsmProxyUrl": "https://proxy:3128"},
+			wantErr: "cannot be used with an HTTPS proxy",
+		},
+		{
+			name:    "proxy CA with proxy IP address",
+			params:  map[string]string{"dsmProxyUrl": "https://10.0.0.1:3128", "dsmProxyCaCert": testCACert},
+			wantErr: "given by host name",
+		},
+		{
+			name:   "proxy CA with proxy host name",
+			params: map[string]string{"dsmProxyUrl": "https://proxy.example.com:3128", "dsmProxyCaCert": testCACert},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params["dsmEndpoint"] = "https://dsm.example.com"
+			_, err := parseForTest(t, tt.params, podSecret, FlagsConfig{})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Parse() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Parse() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// testCACert is a self-signed certificate, only parsed as PEM.
+const testCACert = `-----BEGIN CERTIFICATE-----
+MIIBeTCCAR+gAwIBAgIUdTkDWTGNVLln15hDmgIZFpEz/YYwCgYIKoZIzj0EAwIw
+EjEQMA4GA1UEAwwHVGVzdCBDQTAeFw0yNjEwMTgwNjA1MjhaFw0zNjEwMTUwNjA1
+MjhaMBIxEDAOBgNVBAMMB1Rlc3QgQ0EwWTATBgcqhkjOPQIBBggqhkjOPQMBBwNC
+AARp14cF6/KowFb0EVYLv2jA5sXtGagBONwAzx5FLeCqiXPGtSpY3XrUplhaMRTZ
+jjpQGMWgNlgvVow1DAMWsmIko1MwUTAdBgNVHQ4EFgQULBUpmQjShJaLVGYFVnYt
+PIX/n7gwHwYDVR0jBBgwFoAULBUpmQjShJaLVGYFVnYtPIX/n7gwDwYDVR0TAQH/
+BAUwAwEB/zAKBggqhkjOPQQDAgNIADBFAiEA0yR5dNLtjB8UhAGHPamcBSVNp8P2
+G+7LaCVoEQBzDmkCIC2T5OQEvwB8Tpw0k0+wsB3546JaW485ZawFxl9Qmyrp
+-----END CERTIFICATE-----
+`
@@ -0,0 +1,32 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package config
+
+import "errors"
+
+// RateLimits configure the token buckets requests to DSM are limited by, one
+// per endpoint and one per credential. A zero rate is unlimited.
+type RateLimits struct {
+	// EndpointRate is the number of requests per second to a DSM endpoint,
+	// and EndpointBurst the number of requests that can be made at once.
+	EndpointRate  float64
+	EndpointBurst int
+	// CredentialRate and CredentialBurst limit the requests made with a
+	// single credential.
+	CredentialRate  float64
+	CredentialBurst int
+}
+
+func (r RateLimits) validate() error {
+	if r.EndpointRate < 0 || r.CredentialRate < 0 {
+		return errors.New("invalid rate limit, must not be negative")
+	}
+	if (r.EndpointRate > 0 && r.EndpointBurst < 1) || (r.CredentialRate > 0 && r.CredentialBurst < 1) {
+		return errors.New("invalid rate limit burst, must be at least 1")
+	}
+	return nil
+}
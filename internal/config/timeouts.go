@@ -0,0 +1,33 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Timeouts bound how long the provider waits for DSM. A zero timeout is
+// unbounded, apart from the deadline of the mount request.
+type Timeouts struct {
+	// Connect bounds establishing a connection to DSM, including the TLS
+	// handshake.
+	Connect time.Duration
+	// Read bounds waiting for the response to a request once it is sent.
+	Read time.Duration
+	// Object bounds fetching a single secret, including retries.
+	Object time.Duration
+}
+
+func (t Timeouts) validate() error {
+	for name, timeout := range map[string]time.Duration{"connect": t.Connect, "read": t.Read, "object": t.Object} {
+		if timeout < 0 {
+			return fmt.Errorf("invalid %s timeout %v, must not be negative", name, timeout)
+		}
+	}
+	return nil
+}
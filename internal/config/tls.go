@@ -0,0 +1,121 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSConfig holds the TLS settings used to connect to the DSM endpoint.
+type TLSConfig struct {
+	// CACert holds PEM encoded certificates that are trusted in addition to
+	// the system roots, e.g. the internal CA of an on-prem DSM cluster.
+	CACert []byte
+	// MinVersion is the minimum TLS version, "1.2" or "1.3".
+	MinVersion string
+	// ServerName overrides the host name sent in SNI and verified against
+	// the DSM certificate.
+	ServerName string
+	// PinnedSHA256 lists hex encoded SHA-256 hashes of the
+	// SubjectPublicKeyInfo of certificates. If set, the verified chain of
+	// the DSM endpoint must contain one of them.
+	PinnedSHA256 []string
+}
+
+// IsZero reports whether no TLS setting is configured.
+func (t TLSConfig) IsZero() bool {
+	return len(t.CACert) == 0 && t.MinVersion == "" && t.ServerName == "" && len(t.PinnedSHA256) == 0
+}
+
+// Version returns the minimum TLS version as a crypto/tls constant, which
+// defaults to TLS 1.2.
+func (t TLSConfig) Version() uint16 {
+	if t.MinVersion == "1.3" {
+		return tls.VersionTLS13
+	}
+	return tls.VersionTLS12
+}
+
+// CertPool returns the system roots with CACert added.
+func (t TLSConfig) CertPool() (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if len(t.CACert) > 0 && !pool.AppendCertsFromPEM(t.CACert) {
+		return nil, errors.New("no valid PEM certificate in the DSM CA bundle")
+	}
+	return pool, nil
+}
+
+// parseTLSConfig reads the TLS settings of a SecretProviderClass.
+func parseTLSConfig(params map[string]string) TLSConfig {
+	return TLSConfig{
+		CACert:       []byte(params["dsmCaCert"]),
+		MinVersion:   params["dsmTlsMinVersion"],
+		ServerName:   params["dsmTlsServerName"],
+		PinnedSHA256: parsePins(params["dsmPinnedCertSha256"]),
+	}
+}
+
+// parsePins splits a comma separated list of certificate pins.
+func parsePins(pinsStr string) []string {
+	var pins []string
+	for _, pin := range strings.Split(pinsStr, ",") {
+		if pin = strings.ToLower(strings.TrimSpace(pin)); pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+	return pins
+}
+
+// withDefaults fills the settings not given by the SecretProviderClass from
+// the node-wide flags. The node-wide minimum TLS version cannot be lowered.
+func (t TLSConfig) withDefaults(flags FlagsConfig) (TLSConfig, error) {
+	if len(t.CACert) == 0 && flags.DsmCAFile != "" {
+		caCert, err := os.ReadFile(flags.DsmCAFile)
+		if err != nil {
+			return TLSConfig{}, fmt.Errorf("failed to read DSM CA bundle: %w", err)
+		}
+		t.CACert = caCert
+	}
+	if t.MinVersion == "" || flags.DsmTLSMinVersion > t.MinVersion {
+		t.MinVersion = flags.DsmTLSMinVersion
+	}
+	if t.ServerName == "" {
+		t.ServerName = flags.DsmTLSServerName
+	}
+	if len(t.PinnedSHA256) == 0 {
+		t.PinnedSHA256 = parsePins(flags.DsmPinnedCertSHA256)
+	}
+	return t, nil
+}
+
+func (t TLSConfig) validate() error {
+	switch t.MinVersion {
+	case "", "1.2", "1.3":
+	default:
+		return fmt.Errorf("invalid minimum TLS version %q, must be %q or %q", t.MinVersion, "1.2", "1.3")
+	}
+	if len(t.CACert) > 0 {
+		if !x509.NewCertPool().AppendCertsFromPEM(t.CACert) {
+			return errors.New("no valid PEM certificate in the DSM CA bundle")
+		}
+	}
+	for _, pin := range t.PinnedSHA256 {
+		if hash, err := hex.DecodeString(pin); err != nil || len(hash) != 32 {
+			return fmt.Errorf("invalid certificate pin %q, must be a hex encoded SHA-256 hash", pin)
+		}
+	}
+	return nil
+}
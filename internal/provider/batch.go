@@ -0,0 +1,111 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/client"
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+// maxBatchSize bounds the number of objects exported in a single DSM batch
+// request.
+const maxBatchSize = 20
+
+type exportResult struct {
+	sobject *sdkms.Sobject
+	err     error
+}
+
+// exportedSobjects holds the security objects of a mount that were exported
+// ahead of time in batch requests. Objects missing from it are exported
+// individually.
+type exportedSobjects map[config.ObjectRef]exportResult
+
+// batchExport exports the security objects refs refers to in batch requests.
+// If a batch request fails, e.g. because the DSM version does not support it,
+// its objects are left to be exported individually.
+func (p *Provider) batchExport(
+	ctx context.Context,
+	client *client.SecretClient,
+	refs []config.ObjectRef,
+	timeout time.Duration,
+) exportedSobjects {
+	var unique []config.ObjectRef
+	seen := make(map[config.ObjectRef]bool)
+	for _, ref := range refs {
+		if !seen[ref] {
+			seen[ref] = true
+			unique = append(unique, ref)
+		}
+	}
+	// A single object is exported as cheaply without a batch request.
+	if len(unique) < 2 {
+		return nil
+	}
+
+	// Objects another mount is already exporting are not exported again,
+	// their result is shared once it is available.
+	var leads []config.ObjectRef
+	leadFlights := make(map[config.ObjectRef]*flight)
+	followFlights := make(map[config.ObjectRef]*flight)
+	for _, ref := range unique {
+		f, lead := p.inFlight.claim(flightKey(client, "export", ref))
+		if lead {
+			leads = append(leads, ref)
+			leadFlights[ref] = f
+		} else {
+			followFlights[ref] = f
+		}
+	}
+
+	batches := (len(leads) + maxBatchSize - 1) / maxBatchSize
+	results := make([][]exportResult, batches)
+	_ = forEachParallel(ctx, batches, maxConcurrentFetches, func(ctx context.Context, i int) error {
+		ctx, cancel := withTimeout(ctx, timeout)
+		defer cancel()
+		batch := leads[i*maxBatchSize : min((i+1)*maxBatchSize, len(leads))]
+		descriptors := make([]sdkms.SobjectDescriptor, len(batch))
+		for j, ref := range batch {
+			descriptors[j] = *sobjectDescriptor(ref)
+		}
+		sobjects, errs, err := client.BatchExportSobjects(ctx, descriptors)
+		if err != nil {
+			log.Printf("Batch export of %d Sobjects failed, exporting them individually: %v", len(batch), err)
+			return nil
+		}
+		results[i] = make([]exportResult, len(batch))
+		for j := range batch {
+			results[i][j] = exportResult{sobject: sobjects[j], err: errs[j]}
+		}
+		return nil
+	})
+
+	exported := make(exportedSobjects)
+	for i, batchResults := range results {
+		for j, result := range batchResults {
+			exported[leads[i*maxBatchSize+j]] = result
+		}
+	}
+	// Objects of failed batch requests are finished without a result, so
+	// that mounts waiting for them export them individually.
+	for ref, f := range leadFlights {
+		result, ok := exported[ref]
+		p.inFlight.finish(flightKey(client, "export", ref), f, result, ok)
+	}
+	for ref, f := range followFlights {
+		if result, ok := f.wait(ctx); ok {
+			exported[ref] = result
+		}
+	}
+	return exported
+}
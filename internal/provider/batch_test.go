@@ -0,0 +1,153 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+// batchHandler serves DSM batch exports of objects by name, or fails them
+// with status if it is set. It records the names of each batch, and calls
+// during once a batch request arrives.
+type batchHandler struct {
+	t       *testing.T
+	status  int
+	during  func()
+	batches [][]string
+}
+
+func (h *batchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/batch/v1" {
+		http.NotFound(w, r)
+		return
+	}
+	if h.during != nil {
+		h.during()
+	}
+	var request struct {
+		Batch struct {
+			Items []struct {
+				SingleItem struct {
+					Body struct {
+						Name string `json:"name"`
+					} `json:"body"`
+				}
+			} `json:"items"`
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		h.t.Error(err)
+	}
+	var names []string
+	var items []sdkms.BatchResponse
+	for _, item := range request.Batch.Items {
+		name := item.SingleItem.Body.Name
+		names = append(names, name)
+		sobject := sdkms.Sobject{Name: &name, Creator: sdkms.Principal{System: &struct{}{}}}
+		items = append(items, sdkms.BatchResponse{SingleItem: &sdkms.BatchResponseObject{
+			Result: &sdkms.BatchResponseObjectResult{Status: http.StatusOK, Body: sobject},
+		}})
+	}
+	sort.Strings(names)
+	h.batches = append(h.batches, names)
+	if h.status != 0 {
+		http.Error(w, "batch requests are not supported", h.status)
+		return
+	}
+	response := sdkms.BatchResponse{Batch: &sdkms.BatchResponseList{Items: items}}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		h.t.Error(err)
+	}
+}
+
+func TestBatchExport(t *testing.T) {
+	ref := func(name string) config.ObjectRef { return config.ObjectRef{SecretName: name} }
+	refs := []config.ObjectRef{ref("a"), ref("b"), ref("a"), ref("c")}
+	tests := []struct {
+		name         string
+		status       int
+		wantExported []string
+		wantShared   bool
+	}{
+		{name: "batch exported", wantExported: []string{"a", "b", "c"}, wantShared: true},
+		{name: "batch failed", status: http.StatusBadRequest, wantExported: []string{"c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProvider(nil, nil)
+			handler := &batchHandler{t: t, status: tt.status}
+			secretClient := newTestClient(t, handler.ServeHTTP)
+
+			// Another mount is exporting c, its result is shared.
+			cKey := flightKey(secretClient, "export", ref("c"))
+			cFlight, _ := p.inFlight.claim(cKey)
+			cName := "c"
+			// A third mount asks for a while the batch is in flight.
+			var aFlight *flight
+			handler.during = func() {
+				var lead bool
+				aFlight, lead = p.inFlight.claim(flightKey(secretClient, "export", ref("a")))
+				if lead {
+					t.Error("a is not in flight during the batch request")
+				}
+				p.inFlight.finish(cKey, cFlight, exportResult{sobject: &sdkms.Sobject{Name: &cName}}, true)
+			}
+
+			exported := p.batchExport(context.Background(), secretClient, refs, time.Minute)
+			if want := [][]string{{"a", "b"}}; !reflect.DeepEqual(handler.batches, want) {
+				t.Errorf("batches = %v, want %v", handler.batches, want)
+			}
+			var names []string
+			for r, result := range exported {
+				if result.err != nil || result.sobject == nil || *result.sobject.Name != r.SecretName {
+					t.Errorf("%s: exported %+v", r.SecretName, result)
+				}
+				names = append(names, r.SecretName)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.wantExported) {
+				t.Errorf("exported %v, want %v", names, tt.wantExported)
+			}
+
+			result, ok := aFlight.wait(context.Background())
+			if ok != tt.wantShared {
+				t.Errorf("mount waiting for a got a result: %v, want %v", ok, tt.wantShared)
+			}
+			if ok && (result.sobject == nil || *result.sobject.Name != "a") {
+				t.Errorf("mount waiting for a got %+v", result)
+			}
+			for _, name := range []string{"a", "b", "c"} {
+				if _, lead := p.inFlight.claim(flightKey(secretClient, "export", ref(name))); !lead {
+					t.Errorf("%s is still in flight after the batch export", name)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchExportSingleObject(t *testing.T) {
+	p := NewProvider(nil, nil)
+	handler := &batchHandler{t: t}
+	secretClient := newTestClient(t, handler.ServeHTTP)
+	ref := config.ObjectRef{SecretName: "a"}
+	if exported := p.batchExport(context.Background(), secretClient, []config.ObjectRef{ref, ref}, time.Minute); exported != nil {
+		t.Errorf("batchExport() = %v, want nothing exported ahead of time", exported)
+	}
+	if len(handler.batches) != 0 {
+		t.Errorf("made %d batch requests for a single object", len(handler.batches))
+	}
+}
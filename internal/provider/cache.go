@@ -0,0 +1,262 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/client"
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+	pb "github.com/fortanix/fortanix-csi-provider/internal/v1alpha1"
+)
+
+// cacheSweepInterval is how often expired entries are removed from the
+// cache directory.
+const cacheSweepInterval = time.Hour
+
+// Cache is the node-local last-known-good cache. It keeps the secrets of the
+// last successful mount of SecretProviderClasses that opt into it, encrypted
+// with a node-local key, and serves them while DSM is unavailable.
+type Cache struct {
+	dir    string
+	aead   cipher.AEAD
+	maxAge time.Duration
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// NewCache returns a cache storing entries in dir, encrypted with AES-GCM
+// under a key derived from key. Entries older than maxAge are never served.
+func NewCache(dir string, key []byte, maxAge time.Duration) (*Cache, error) {
+	if len(key) == 0 {
+		return nil, errors.New("the cache key is empty")
+	}
+	if maxAge <= 0 {
+		return nil, fmt.Errorf("invalid cache max age %v, must be positive", maxAge)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	aesKey := sha256.Sum256(key)
+	block, err := aes.NewCipher(aesKey[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir, aead: aead, maxAge: maxAge}, nil
+}
+
+// cacheEntry is the plaintext of a cached secret.
+type cacheEntry struct {
+	StoredAt time.Time `json:"storedAt"`
+	// Identity binds the entry to the DSM endpoint and credential it was
+	// fetched with, so that it is only served to mounts that could fetch
+	// it themselves.
+	Identity      string      `json:"identity"`
+	Version       string      `json:"version"`
+	ObjectVersion string      `json:"objectVersion"`
+	Files         []cacheFile `json:"files"`
+}
+
+type cacheFile struct {
+	Path    string `json:"path"`
+	Content []byte `json:"content"`
+}
+
+// cacheKey identifies a secret of a SecretProviderClass in the cache. Like
+// mountedSecretKey, it covers the whole secret configuration.
+func cacheKey(namespace, secretProviderClass string, secret config.Secret) (string, error) {
+	cfg, err := json.Marshal(secret)
+	if err != nil {
+		return "", err
+	}
+	return namespace + "/" + secretProviderClass + "\x00" + string(cfg), nil
+}
+
+func (c *Cache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(hash[:]))
+}
+
+func (c *Cache) store(key, identity string, mounted *mountedSecret, now time.Time) error {
+	entry := cacheEntry{
+		StoredAt:      now,
+		Identity:      identity,
+		Version:       mounted.version,
+		ObjectVersion: mounted.objectVersion.GetVersion(),
+	}
+	for _, file := range mounted.files {
+		entry.Files = append(entry.Files, cacheFile{Path: file.path, Content: file.content})
+	}
+	plaintext, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	// The key is authenticated along with the entry, so that an entry cannot
+	// be served for another secret by renaming its file.
+	ciphertext := c.aead.Seal(nonce, nonce, plaintext, []byte(key))
+
+	tmp, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(ciphertext); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(key))
+}
+
+// load returns the cached secret for key, if it was stored with identity no
+// longer than maxAge ago.
+func (c *Cache) load(key, identity string, objectVersionID string, maxAge time.Duration, now time.Time) (*mountedSecret, error) {
+	ciphertext, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("cache entry is corrupt")
+	}
+	plaintext, err := c.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], []byte(key))
+	if err != nil {
+		return nil, errors.New("cache entry cannot be decrypted")
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(plaintext, &entry); err != nil {
+		return nil, err
+	}
+	if entry.Identity != identity {
+		return nil, errors.New("cache entry was stored with another credential")
+	}
+	if age := now.Sub(entry.StoredAt); age > min(maxAge, c.maxAge) {
+		return nil, fmt.Errorf("cache entry is %v old", age.Round(time.Second))
+	}
+
+	mounted := &mountedSecret{
+		version:       entry.Version,
+		objectVersion: &pb.ObjectVersion{Id: objectVersionID, Version: entry.ObjectVersion},
+	}
+	for _, file := range entry.Files {
+		mounted.files = append(mounted.files, secretFile{path: file.Path, content: file.Content})
+	}
+	return mounted, nil
+}
+
+// sweep removes entries that are too old to be served, at most once per
+// cacheSweepInterval.
+func (c *Cache) sweep(now time.Time) {
+	c.mu.Lock()
+	if now.Sub(c.lastSweep) < cacheSweepInterval {
+		c.mu.Unlock()
+		return
+	}
+	c.lastSweep = now
+	c.mu.Unlock()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Printf("Could not sweep the cache: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && now.Sub(info.ModTime()) > c.maxAge {
+			_ = os.Remove(filepath.Join(c.dir, entry.Name()))
+		}
+	}
+}
+
+// cacheIdentity identifies who may be served a cached secret. With JWT
+// authentication the token changes with every pod, so the DSM app and the
+// service account the token is issued to are used instead.
+func cacheIdentity(cfg config.Config, parameters config.SpcParameters) string {
+	if parameters.AuthMethod == config.AuthMethodJWT {
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s", parameters.DsmEndpoint, parameters.AppID,
+			cfg.Parameters.Namespace, cfg.Parameters.ServiceAccountName)
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+	return client.CredentialKey(parameters)
+}
+
+// cacheMounts stores the secrets of a successful mount in the cache, if the
+// SecretProviderClass opted into it.
+func (p *Provider) cacheMounts(cfg config.Config, mounts []*mountedSecret) {
+	lkg := cfg.Parameters.LastKnownGoodCache
+	if p.cache == nil || !lkg.Enabled {
+		return
+	}
+	now := time.Now()
+	p.cache.sweep(now)
+	identity := cacheIdentity(cfg, spcParameters(cfg))
+	for i, secret := range cfg.Parameters.Secrets {
+		key, err := cacheKey(cfg.Parameters.Namespace, lkg.SecretProviderClass, secret)
+		if err == nil {
+			err = p.cache.store(key, identity, mounts[i], now)
+		}
+		if err != nil {
+			log.Printf("Could not cache %v: %v", secret.Identifier(), err)
+		}
+	}
+}
+
+// cachedMounts returns the cached secrets of a SecretProviderClass if the
+// mount failed because DSM is unavailable, and all of them are cached and
+// fresh enough.
+func (p *Provider) cachedMounts(cfg config.Config, mountErr error) []*mountedSecret {
+	lkg := cfg.Parameters.LastKnownGoodCache
+	if p.cache == nil || !lkg.Enabled {
+		return nil
+	}
+	switch Classify(mountErr) {
+	case ErrorCodeDSMUnavailable, ErrorCodeCircuitOpen, ErrorCodeTimeout:
+	default:
+		return nil
+	}
+
+	now := time.Now()
+	identity := cacheIdentity(cfg, spcParameters(cfg))
+	mounts := make([]*mountedSecret, len(cfg.Parameters.Secrets))
+	for i, secret := range cfg.Parameters.Secrets {
+		key, err := cacheKey(cfg.Parameters.Namespace, lkg.SecretProviderClass, secret)
+		if err == nil {
+			mounts[i], err = p.cache.load(key, identity, secret.ObjectVersionID(), lkg.MaxAge, now)
+		}
+		if err != nil {
+			log.Printf("DSM is unavailable and %v cannot be served from the cache: %v", secret.Identifier(), err)
+			return nil
+		}
+	}
+	log.Printf("DSM is unavailable, serving %d secrets of %s/%s from the cache: %v",
+		len(mounts), cfg.Parameters.Namespace, lkg.SecretProviderClass, mountErr)
+	return mounts
+}
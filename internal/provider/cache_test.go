@@ -0,0 +1,111 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	pb "github.com/fortanix/fortanix-csi-provider/internal/v1alpha1"
+)
+
+func TestCacheStoreLoad(t *testing.T) {
+	const (
+		key             = "team-a/spc\x00secret"
+		identity        = "identity"
+		objectVersionID = "secretName/db-password"
+		maxAge          = time.Hour
+	)
+	stored := &mountedSecret{
+		version:       "v1",
+		objectVersion: &pb.ObjectVersion{Id: objectVersionID, Version: "1"},
+		files:         []secretFile{{path: "db-password", content: []byte("hunter2")}},
+	}
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name     string
+		key      string
+		identity string
+		maxAge   time.Duration
+		now      time.Time
+		wantErr  bool
+	}{
+		{name: "round trip", key: key, identity: identity, maxAge: maxAge, now: now},
+		{name: "wrong identity", key: key, identity: "other", maxAge: maxAge, now: now, wantErr: true},
+		{name: "unknown key", key: "team-b/spc\x00secret", identity: identity, maxAge: maxAge, now: now, wantErr: true},
+		{name: "expired", key: key, identity: identity, maxAge: maxAge, now: now.Add(2 * maxAge), wantErr: true},
+		{
+			name:     "expired for the secret provider class",
+			key:      key,
+			identity: identity,
+			maxAge:   time.Minute,
+			now:      now.Add(2 * time.Minute),
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, err := NewCache(t.TempDir(), []byte("cache key"), maxAge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cache.store(key, identity, stored, now); err != nil {
+				t.Fatal(err)
+			}
+			got, err := cache.load(tt.key, tt.identity, objectVersionID, tt.maxAge, tt.now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.version != stored.version || !reflect.DeepEqual(got.files, stored.files) ||
+				got.objectVersion.GetId() != objectVersionID || got.objectVersion.GetVersion() != "1" {
+				t.Errorf("load() = %+v, want %+v", got, stored)
+			}
+		})
+	}
+}
+
+func TestCacheRejectsOtherKey(t *testing.T) {
+	dir := t.TempDir()
+	stored := &mountedSecret{
+		objectVersion: &pb.ObjectVersion{Version: "1"},
+		files:         []secretFile{{path: "a", content: []byte("a")}},
+	}
+	now := time.Now()
+	cache, err := NewCache(dir, []byte("cache key"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.store("a", "identity", stored, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry renamed to the file of another key is not served for it.
+	if err := os.Rename(cache.path("a"), cache.path("b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.load("b", "identity", "", time.Hour, now); err == nil {
+		t.Error("load() served an entry stored for another key")
+	}
+
+	// Neither is an entry encrypted under another cache key.
+	if err := cache.store("a", "identity", stored, now); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewCache(dir, []byte("other key"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.load("a", "identity", "", time.Hour, now); err == nil {
+		t.Error("load() decrypted an entry stored under another cache key")
+	}
+}
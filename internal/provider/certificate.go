@@ -0,0 +1,78 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"context"
+	"encoding/pem"
+	"path"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/client"
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+// getCertificateFiles assembles a certificate and its issuers into a PEM
+// bundle. With TLSFiles set, the bundle, the issuers and the private key are
+// written as separate files in the secret's directory. Like getSecret, it
+// also returns the security objects the files were built from.
+func (p *Provider) getCertificateFiles(
+	ctx context.Context,
+	client *client.SecretClient,
+	exported exportedSobjects,
+	secretConfig config.Secret,
+	leaf *sdkms.Sobject,
+) ([]secretFile, []*sdkms.Sobject, error) {
+	if leaf.ObjType != sdkms.ObjectTypeCertificate {
+		return nil, nil, configError("Sobject %v is of type %v, `chain` and `tlsFiles` require a certificate",
+			secretConfig.Identifier(), leaf.ObjType)
+	}
+
+	sobjects := []*sdkms.Sobject{leaf}
+	var issuers []byte
+	for _, ref := range secretConfig.Chain {
+		issuer, err := p.exportSobject(ctx, client, exported, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		if issuer.ObjType != sdkms.ObjectTypeCertificate {
+			return nil, nil, configError("chain entry %v of Sobject %v is of type %v, expected a certificate",
+				ref.Identifier(), secretConfig.Identifier(), issuer.ObjType)
+		}
+		issuers = append(issuers, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: *issuer.Value})...)
+		sobjects = append(sobjects, issuer)
+	}
+	bundle := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: *leaf.Value}), issuers...)
+
+	if !secretConfig.TLSFiles {
+		return []secretFile{{path: secretConfig.FilePath(), content: bundle}}, sobjects, nil
+	}
+
+	dir := secretConfig.FilePath()
+	files := []secretFile{{path: path.Join(dir, config.TLSCertFileName), content: bundle}}
+	if len(issuers) > 0 {
+		files = append(files, secretFile{path: path.Join(dir, config.CACertFileName), content: issuers})
+	}
+	if secretConfig.PrivateKey != nil {
+		key, err := p.exportSobject(ctx, client, exported, *secretConfig.PrivateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if (key.ObjType != sdkms.ObjectTypeRsa && key.ObjType != sdkms.ObjectTypeEc) || key.PublicOnly {
+			return nil, nil, configError("private key %v of Sobject %v is of type %v, expected an RSA or EC private key",
+				secretConfig.PrivateKey.Identifier(), secretConfig.Identifier(), key.ObjType)
+		}
+		content, err := encodeContent(config.EncodingPEM, pemTypeOf(key, *key.Value), *key.Value)
+		if err != nil {
+			return nil, nil, configError("could not encode private key %v: %w", secretConfig.PrivateKey.Identifier(), err)
+		}
+		files = append(files, secretFile{path: path.Join(dir, config.TLSKeyFileName), content: content})
+		sobjects = append(sobjects, key)
+	}
+	return files, sobjects, nil
+}
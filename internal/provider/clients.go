@@ -0,0 +1,127 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/client"
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+const (
+	// clientIdleTimeout bounds how long a DSM client is kept after its last
+	// mount, so that clients of short-lived credentials, e.g. service account
+	// tokens, are dropped.
+	clientIdleTimeout = 10 * time.Minute
+	// maxClients bounds the number of DSM clients kept. The least recently
+	// used client is dropped to make room for a new one.
+	maxClients = 64
+)
+
+type pooledClient struct {
+	client   *client.SecretClient
+	lastUsed time.Time
+	// refs counts the mounts using the client. Clients in use are not
+	// evicted, so that their connections are not leaked by a client that
+	// is no longer pooled.
+	refs int
+}
+
+// clientPool keeps the DSM clients of previous mounts, so that mounts with the
+// same endpoint and credential reuse their connections and session.
+type clientPool struct {
+	mu      sync.Mutex
+	clients map[string]*pooledClient
+}
+
+func newClientPool() *clientPool {
+	return &clientPool{clients: make(map[string]*pooledClient)}
+}
+
+// get returns the client for parameters, creating it if there is none. The
+// client is created without holding the lock, as loading its certificates
+// can take a while. release must be called once the mount is done with it.
+func (p *clientPool) get(
+	parameters config.SpcParameters,
+	now time.Time,
+) (secretClient *client.SecretClient, release func(), err error) {
+	key := client.Key(parameters)
+
+	p.mu.Lock()
+	p.evictIdle(now)
+	if pooled, ok := p.clients[key]; ok {
+		defer p.mu.Unlock()
+		return p.acquire(pooled, now)
+	}
+	p.mu.Unlock()
+
+	secretClient, err = client.NewSecretClient(parameters)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// A concurrent mount may have created the client in the meantime.
+	if pooled, ok := p.clients[key]; ok {
+		secretClient.Close()
+		return p.acquire(pooled, now)
+	}
+	if len(p.clients) >= maxClients {
+		p.evictLeastRecentlyUsed()
+	}
+	pooled := &pooledClient{client: secretClient}
+	p.clients[key] = pooled
+	return p.acquire(pooled, now)
+}
+
+func (p *clientPool) acquire(pooled *pooledClient, now time.Time) (*client.SecretClient, func(), error) {
+	pooled.refs++
+	pooled.lastUsed = now
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			pooled.refs--
+			pooled.lastUsed = time.Now()
+		})
+	}
+	return pooled.client, release, nil
+}
+
+func (p *clientPool) evictIdle(now time.Time) {
+	for key, pooled := range p.clients {
+		if pooled.refs == 0 && now.Sub(pooled.lastUsed) > clientIdleTimeout {
+			p.evict(key)
+		}
+	}
+}
+
+// evictLeastRecentlyUsed makes room for a new client. If all clients are in
+// use, none is evicted and the pool exceeds maxClients until they are
+// released.
+func (p *clientPool) evictLeastRecentlyUsed() {
+	var lruKey string
+	var lruTime time.Time
+	for key, pooled := range p.clients {
+		if pooled.refs == 0 && (lruKey == "" || pooled.lastUsed.Before(lruTime)) {
+			lruKey, lruTime = key, pooled.lastUsed
+		}
+	}
+	if lruKey != "" {
+		p.evict(lruKey)
+	}
+}
+
+// evict drops a client that no mount is using and closes its connections.
+func (p *clientPool) evict(key string) {
+	p.clients[key].client.Close()
+	delete(p.clients, key)
+}
@@ -0,0 +1,67 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+// maxMountDeadlineMargin bounds the time reserved between the end of the
+// mount budget and the deadline of the mount request. Up to a tenth of the
+// remaining time is reserved.
+const maxMountDeadlineMargin = 2 * time.Second
+
+// mountContext returns the context a mount runs in. Its deadline leaves a
+// margin before the deadline of the mount request, so that a mount running
+// out of time fails with an error telling which objects are missing, instead
+// of the driver giving up with an opaque deadline error.
+func mountContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	margin := min(time.Until(deadline)/10, maxMountDeadlineMargin)
+	return context.WithDeadline(ctx, deadline.Add(-margin))
+}
+
+// withTimeout bounds ctx by timeout, unless it is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// objectTimeoutError reports a secret that could not be fetched within the
+// per-object timeout, if that is why err occurred.
+func objectTimeoutError(ctx, objectCtx context.Context, secret config.Secret, timeout time.Duration, err error) error {
+	if errors.Is(objectCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return NewMountError(ErrorCodeTimeout, fmt.Errorf("fetching %v timed out after %v", secret.Identifier(), timeout))
+	}
+	return err
+}
+
+// partialMountError reports a mount that ran out of time, listing the secrets
+// that were not fetched.
+func partialMountError(secrets []config.Secret, mounts []*mountedSecret) error {
+	var missing []string
+	for i, secret := range secrets {
+		if mounts[i] == nil {
+			missing = append(missing, secret.Identifier())
+		}
+	}
+	return NewMountError(ErrorCodeTimeout, fmt.Errorf(
+		"mount ran out of time with %d of %d objects fetched, missing: %s",
+		len(secrets)-len(missing), len(secrets), strings.Join(missing, ", "),
+	))
+}
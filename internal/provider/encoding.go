@@ -0,0 +1,62 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+const pemTypePublicKey = "PUBLIC KEY"
+
+// encodeContent serializes content according to the configured encoding.
+// pemType is the PEM block type used for the `pem` encoding; it is empty if
+// the content has no PEM representation.
+func encodeContent(encoding config.Encoding, pemType string, content []byte) ([]byte, error) {
+	switch encoding {
+	case "", config.EncodingRaw, config.EncodingDER:
+		return content, nil
+	case config.EncodingBase64:
+		return []byte(base64.StdEncoding.EncodeToString(content)), nil
+	case config.EncodingHex:
+		return []byte(hex.EncodeToString(content)), nil
+	case config.EncodingPEM:
+		if pemType == "" {
+			return nil, fmt.Errorf("content has no PEM representation")
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: content}), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// pemTypeOf returns the PEM block type for the exported value of sobject, or
+// an empty string if objects of its type have no PEM representation.
+func pemTypeOf(sobject *sdkms.Sobject, value []byte) string {
+	switch sobject.ObjType {
+	case sdkms.ObjectTypeCertificate:
+		return "CERTIFICATE"
+	case sdkms.ObjectTypeRsa, sdkms.ObjectTypeEc:
+		if sobject.PublicOnly {
+			return pemTypePublicKey
+		}
+		if _, err := x509.ParsePKCS8PrivateKey(value); err == nil {
+			return "PRIVATE KEY"
+		}
+		if sobject.ObjType == sdkms.ObjectTypeRsa {
+			return "RSA PRIVATE KEY"
+		}
+		return "EC PRIVATE KEY"
+	}
+	return ""
+}
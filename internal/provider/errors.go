@@ -0,0 +1,128 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+	"google.golang.org/grpc/codes"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/client"
+)
+
+// ErrorCode classifies why a mount failed. It is reported to the driver in
+// MountResponse.Error.Code, which the driver uses for events and metrics.
+type ErrorCode string
+
+const (
+	ErrorCodeAuthFailure    ErrorCode = "AuthFailure"
+	ErrorCodeObjectNotFound ErrorCode = "ObjectNotFound"
+	ErrorCodeNotExportable  ErrorCode = "NotExportable"
+	ErrorCodeRateLimited    ErrorCode = "RateLimited"
+	ErrorCodeDSMUnavailable ErrorCode = "DSMUnavailable"
+	ErrorCodeCircuitOpen    ErrorCode = "CircuitOpen"
+	ErrorCodeTimeout        ErrorCode = "Timeout"
+	ErrorCodeConfigInvalid  ErrorCode = "ConfigInvalid"
+	ErrorCodeInternal       ErrorCode = "Internal"
+)
+
+// GRPCCode maps the error code to the closest gRPC status code, which is
+// logged with failed mounts.
+func (c ErrorCode) GRPCCode() codes.Code {
+	switch c {
+	case ErrorCodeAuthFailure:
+		return codes.Unauthenticated
+	case ErrorCodeObjectNotFound:
+		return codes.NotFound
+	case ErrorCodeNotExportable:
+		return codes.FailedPrecondition
+	case ErrorCodeRateLimited:
+		return codes.ResourceExhausted
+	case ErrorCodeDSMUnavailable, ErrorCodeCircuitOpen:
+		return codes.Unavailable
+	case ErrorCodeTimeout:
+		return codes.DeadlineExceeded
+	case ErrorCodeConfigInvalid:
+		return codes.InvalidArgument
+	}
+	return codes.Internal
+}
+
+// MountError is an error with an explicit classification. Errors returned
+// by DSM do not need to be wrapped, they are classified by their status.
+type MountError struct {
+	Code ErrorCode
+	Err  error
+}
+
+func NewMountError(code ErrorCode, err error) *MountError {
+	return &MountError{Code: code, Err: err}
+}
+
+func (e *MountError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MountError) Unwrap() error {
+	return e.Err
+}
+
+// Classify returns the error code of an error returned by the provider.
+func Classify(err error) ErrorCode {
+	var mountErr *MountError
+	if errors.As(err, &mountErr) {
+		return mountErr.Code
+	}
+
+	if errors.Is(err, client.ErrCircuitOpen) {
+		return ErrorCodeCircuitOpen
+	}
+	if errors.Is(err, client.ErrRateLimited) {
+		return ErrorCodeRateLimited
+	}
+
+	var backendErr *sdkms.BackendError
+	if errors.As(err, &backendErr) {
+		switch {
+		case backendErr.StatusCode == http.StatusUnauthorized:
+			return ErrorCodeAuthFailure
+		case backendErr.StatusCode == http.StatusForbidden:
+			if strings.Contains(strings.ToLower(backendErr.Message), "export") {
+				return ErrorCodeNotExportable
+			}
+			return ErrorCodeAuthFailure
+		case backendErr.StatusCode == http.StatusNotFound:
+			return ErrorCodeObjectNotFound
+		case backendErr.StatusCode == http.StatusTooManyRequests:
+			return ErrorCodeRateLimited
+		case backendErr.StatusCode >= http.StatusInternalServerError:
+			return ErrorCodeDSMUnavailable
+		}
+		return ErrorCodeInternal
+	}
+
+	// Transport errors are wrapped in *url.Error, which is a net.Error, so
+	// failures to verify DSM are told apart from DSM being unreachable first.
+	if client.IsTLSConfigError(err) {
+		return ErrorCodeConfigInvalid
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorCodeDSMUnavailable
+	}
+	return ErrorCodeInternal
+}
+
+func configError(format string, a ...interface{}) error {
+	return NewMountError(ErrorCodeConfigInvalid, fmt.Errorf(format, a...))
+}
@@ -0,0 +1,86 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/client"
+)
+
+// transportError wraps err like sdkms does with errors of its HTTP client.
+func transportError(err error) error {
+	return &url.Error{Op: "Post", URL: "https://dsm.example.com/sys/v1/session/auth", Err: err}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorCode
+	}{
+		{name: "mount error", err: NewMountError(ErrorCodeTimeout, errors.New("slow")), want: ErrorCodeTimeout},
+		{
+			name: "wrapped mount error",
+			err:  fmt.Errorf("mount: %w", configError("bad %s", "config")),
+			want: ErrorCodeConfigInvalid,
+		},
+		{name: "circuit open", err: transportError(client.ErrCircuitOpen), want: ErrorCodeCircuitOpen},
+		{name: "rate limited", err: transportError(client.ErrRateLimited), want: ErrorCodeRateLimited},
+		{name: "unauthorized", err: &sdkms.BackendError{StatusCode: 401}, want: ErrorCodeAuthFailure},
+		{
+			name: "not exportable",
+			err:  &sdkms.BackendError{StatusCode: 403, Message: "Security object is not exportable"},
+			want: ErrorCodeNotExportable,
+		},
+		{name: "forbidden", err: &sdkms.BackendError{StatusCode: 403}, want: ErrorCodeAuthFailure},
+		{name: "not found", err: &sdkms.BackendError{StatusCode: 404}, want: ErrorCodeObjectNotFound},
+		{name: "too many requests", err: &sdkms.BackendError{StatusCode: 429}, want: ErrorCodeRateLimited},
+		{name: "server error", err: &sdkms.BackendError{StatusCode: 503}, want: ErrorCodeDSMUnavailable},
+		{name: "bad request", err: &sdkms.BackendError{StatusCode: 400}, want: ErrorCodeInternal},
+		{
+			name: "unknown authority",
+			err:  transportError(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}),
+			want: ErrorCodeConfigInvalid,
+		},
+		{
+			name: "wrong server name",
+			err:  transportError(x509.HostnameError{Host: "dsm.example.com", Certificate: &x509.Certificate{}}),
+			want: ErrorCodeConfigInvalid,
+		},
+		{
+			name: "expired certificate",
+			err:  transportError(x509.CertificateInvalidError{Reason: x509.Expired}),
+			want: ErrorCodeConfigInvalid,
+		},
+		{name: "TLS alert", err: transportError(tls.AlertError(42)), want: ErrorCodeConfigInvalid},
+		{
+			name: "connection refused",
+			err:  transportError(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}),
+			want: ErrorCodeDSMUnavailable,
+		},
+		{name: "deadline", err: context.DeadlineExceeded, want: ErrorCodeDSMUnavailable},
+		{name: "other", err: errors.New("boom"), want: ErrorCodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify(tt.err); got != tt.want {
+				t.Errorf("Classify(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+// getJSONFields extracts the configured fields from a secret holding a JSON
+// document. String values are written as is, any other value is written as
+// compact JSON.
+func getJSONFields(secretConfig config.Secret, value []byte) ([]secretFile, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var document interface{}
+	// Decoding errors quote the secret value, so they are not passed on.
+	if err := decoder.Decode(&document); err != nil {
+		return nil, configError("Sobject %v does not hold a JSON document", secretConfig.Identifier())
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, configError("Sobject %v does not hold a JSON document", secretConfig.Identifier())
+	}
+
+	files := make([]secretFile, 0, len(secretConfig.JSONPath))
+	for i, field := range secretConfig.JSONPath {
+		elems, err := config.ParseJSONPath(field.Path)
+		if err != nil {
+			return nil, err
+		}
+		fieldValue, err := resolveJSONPath(document, elems)
+		if err != nil {
+			return nil, configError("jsonPath %q of Sobject %v: %w", field.Path, secretConfig.Identifier(), err)
+		}
+
+		var content []byte
+		if str, ok := fieldValue.(string); ok {
+			content = []byte(str)
+		} else if content, err = json.Marshal(fieldValue); err != nil {
+			return nil, fmt.Errorf("jsonPath %q of Sobject %v: %w", field.Path, secretConfig.Identifier(), err)
+		}
+		content, err = encodeContent(secretConfig.Encoding, "", content)
+		if err != nil {
+			return nil, configError("could not encode jsonPath %q of Sobject %v: %w",
+				field.Path, secretConfig.Identifier(), err)
+		}
+		files = append(files, secretFile{path: secretConfig.FilePaths()[i], content: content})
+	}
+	return files, nil
+}
+
+func resolveJSONPath(document interface{}, elems []config.JSONPathElem) (interface{}, error) {
+	current := document
+	for i, elem := range elems {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			if elem.IsIndex {
+				return nil, fmt.Errorf("element %d: cannot index an object with [%d]", i, elem.Index)
+			}
+			value, ok := node[elem.Key]
+			if !ok {
+				return nil, fmt.Errorf("element %d: key %q not found", i, elem.Key)
+			}
+			current = value
+		case []interface{}:
+			if !elem.IsIndex {
+				return nil, fmt.Errorf("element %d: cannot look up key %q in an array", i, elem.Key)
+			}
+			if elem.Index >= len(node) {
+				return nil, fmt.Errorf("element %d: index %d out of range, array has %d elements",
+					i, elem.Index, len(node))
+			}
+			current = node[elem.Index]
+		default:
+			return nil, fmt.Errorf("element %d: cannot look up %q, the value is not an object or array",
+				i, elem.String())
+		}
+	}
+	return current, nil
+}
@@ -0,0 +1,114 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+func TestResolveJSONPath(t *testing.T) {
+	const document = `{
+		"db": {"username": "admin", "port": 5432},
+		"hosts": ["a", "b"],
+		"a.b": true
+	}`
+	tests := []struct {
+		path    string
+		want    interface{}
+		wantErr bool
+	}{
+		{path: "$.db.username", want: "admin"},
+		{path: "$.db.port", want: json.Number("5432")},
+		{path: "$.hosts[1]", want: "b"},
+		{path: "$['a.b']", want: true},
+		{path: "$.hosts", want: []interface{}{"a", "b"}},
+		{path: "$.db.password", wantErr: true},
+		{path: "$.hosts[2]", wantErr: true},
+		{path: "$.hosts.first", wantErr: true},
+		{path: "$.db[0]", wantErr: true},
+		{path: "$.db.username.first", wantErr: true},
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(document)))
+	decoder.UseNumber()
+	var parsed interface{}
+	if err := decoder.Decode(&parsed); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			elems, err := config.ParseJSONPath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := resolveJSONPath(parsed, elems)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveJSONPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveJSONPath(%q) = %#v, want %#v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetJSONFields(t *testing.T) {
+	secret := config.Secret{
+		ObjectRef: config.ObjectRef{SecretName: "db"},
+		JSONPath:  []config.JSONField{{Path: "$.username"}, {Path: "$.port"}},
+	}
+	tests := []struct {
+		name    string
+		value   string
+		want    []secretFile
+		wantErr bool
+	}{
+		{
+			name:  "document",
+			value: `{"username": "admin", "port": 5432}`,
+			want: []secretFile{
+				{path: "db/username", content: []byte("admin")},
+				{path: "db/port", content: []byte("5432")},
+			},
+		},
+		{
+			name:  "trailing whitespace",
+			value: "{\"username\": \"admin\", \"port\": 5432}\n",
+			want: []secretFile{
+				{path: "db/username", content: []byte("admin")},
+				{path: "db/port", content: []byte("5432")},
+			},
+		},
+		{name: "trailing data", value: `{"username": "admin", "port": 5432}hunter2`, wantErr: true},
+		{name: "second document", value: `{"username": "admin", "port": 5432} {}`, wantErr: true},
+		{name: "not JSON", value: `hunter2`, wantErr: true},
+		{name: "missing field", value: `{"username": "admin"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getJSONFields(secret, []byte(tt.value))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getJSONFields() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if strings.Contains(err.Error(), "hunter2") || strings.Contains(err.Error(), "'h'") {
+					t.Errorf("getJSONFields() error %q reveals the secret value", err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getJSONFields() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEachParallelBoundsConcurrency(t *testing.T) {
+	const n, limit = 20, 3
+	var running, maxRunning atomic.Int32
+	var called [n]atomic.Int32
+	err := forEachParallel(context.Background(), n, limit, func(ctx context.Context, i int) error {
+		current := running.Add(1)
+		defer running.Add(-1)
+		for {
+			seen := maxRunning.Load()
+			if current <= seen || maxRunning.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+		called[i].Add(1)
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range called {
+		if c := called[i].Load(); c != 1 {
+			t.Errorf("index %d called %d times, want once", i, c)
+		}
+	}
+	if m := maxRunning.Load(); m > limit {
+		t.Errorf("%d calls ran at the same time, want at most %d", m, limit)
+	}
+}
+
+func TestForEachParallelFailsFast(t *testing.T) {
+	const n, limit = 10, 2
+	errFetch := errors.New("fetch failed")
+	var started atomic.Int32
+	err := forEachParallel(context.Background(), n, limit, func(ctx context.Context, i int) error {
+		started.Add(1)
+		if i == 0 {
+			return errFetch
+		}
+		// The other calls only return once the failure cancels them.
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != errFetch {
+		t.Errorf("forEachParallel() error = %v, want %v", err, errFetch)
+	}
+	if s := started.Load(); s != limit {
+		t.Errorf("%d calls started, want %d: no call should start after the failure", s, limit)
+	}
+}
+
+func TestForEachParallelCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var started atomic.Int32
+	err := forEachParallel(ctx, 5, 2, func(ctx context.Context, i int) error {
+		started.Add(1)
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("forEachParallel() error = %v, want %v", err, context.Canceled)
+	}
+	if s := started.Load(); s != 0 {
+		t.Errorf("%d calls started after the mount was canceled", s)
+	}
+}
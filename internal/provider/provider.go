@@ -11,10 +11,12 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/fortanix/sdkms-client-go/sdkms"
 
@@ -23,93 +25,333 @@ import (
 	pb "github.com/fortanix/fortanix-csi-provider/internal/v1alpha1"
 )
 
-type provider struct{}
+// Provider fetches secrets from DSM for mount requests. It keeps the result
+// of previous mounts so that rotation polls can skip unchanged objects, and
+// their DSM clients so that connections are reused.
+type Provider struct {
+	// hmacKey is a node-local key used to derive object versions. If nil,
+	// versions are derived from DSM metadata.
+	hmacKey []byte
 
-func NewProvider() *provider {
-	p := &provider{}
+	clients *clientPool
+	// cache is the last-known-good cache, or nil if it is not enabled on
+	// the node.
+	cache *Cache
+	// inFlight shares DSM requests between concurrent mounts.
+	inFlight *flightGroup
+
+	mu     sync.Mutex
+	mounts map[string]*mountedSecret
+}
+
+func NewProvider(hmacKey []byte, cache *Cache) *Provider {
+	p := &Provider{
+		hmacKey:  hmacKey,
+		clients:  newClientPool(),
+		cache:    cache,
+		inFlight: newFlightGroup(),
+		mounts:   make(map[string]*mountedSecret),
+	}
 	return p
 }
 
-func (p *provider) getSecret(
+// secretFile is a single file produced from a configured secret, with a path
+// relative to the mount target.
+type secretFile struct {
+	path    string
+	content []byte
+}
+
+// getSecret fetches the files of a secret. It also returns the security
+// objects they were built from, in the order of secretConfig.ObjectRefs().
+func (p *Provider) getSecret(
 	ctx context.Context,
 	client *client.SecretClient,
+	exported exportedSobjects,
 	secretConfig config.Secret,
-) ([]byte, error) {
-	secretName := secretConfig.SecretName
-	sobjectreq := sdkms.SobjectByName(secretName)
-	sobject, err := client.ExportSobject(ctx, *sobjectreq)
+) ([]secretFile, []*sdkms.Sobject, error) {
+	if secretConfig.Export == config.ExportPublicKey {
+		content, sobject, err := p.getPublicKey(ctx, client, secretConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []secretFile{{path: secretConfig.FilePath(), content: content}}, []*sdkms.Sobject{sobject}, nil
+	}
+
+	sobject, err := p.exportSobject(ctx, client, exported, secretConfig.ObjectRef)
+	if err != nil {
+		return nil, nil, err
+	}
+	if secretConfig.IsCertificateBundle() {
+		return p.getCertificateFiles(ctx, client, exported, secretConfig, sobject)
+	}
+	var files []secretFile
+	if len(secretConfig.JSONPath) > 0 {
+		files, err = getJSONFields(secretConfig, *sobject.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		content, err := encodeContent(secretConfig.Encoding, pemTypeOf(sobject, *sobject.Value), *sobject.Value)
+		if err != nil {
+			return nil, nil, configError("could not encode Sobject %v of type %v: %w",
+				secretConfig.Identifier(), sobject.ObjType, err)
+		}
+		files = []secretFile{{path: secretConfig.FilePath(), content: content}}
+	}
+	return files, []*sdkms.Sobject{sobject}, nil
+}
+
+// exportSobject exports a security object, which must have a value, unless
+// it was already exported in a batch request.
+func (p *Provider) exportSobject(
+	ctx context.Context,
+	client *client.SecretClient,
+	exported exportedSobjects,
+	ref config.ObjectRef,
+) (*sdkms.Sobject, error) {
+	secretName := ref.Identifier()
+	result, ok := exported[ref]
+	if !ok {
+		result.sobject, result.err = p.inFlight.do(ctx, flightKey(client, "export", ref), func() (*sdkms.Sobject, error) {
+			return client.ExportSobject(ctx, *sobjectDescriptor(ref))
+		})
+	}
+	sobject, err := result.sobject, result.err
 	if err != nil {
 		log.Printf("Error! Could not fetch the Sobject %v: %v", secretName, err)
 		return nil, err
 	}
 	if sobject.Value == nil {
-		return nil, fmt.Errorf("Sobject %v has no value", secretName)
+		return nil, NewMountError(ErrorCodeNotExportable, fmt.Errorf("Sobject %v has no value", secretName))
+	}
+	return sobject, nil
+}
+
+// getPublicKey looks up the public half of an asymmetric security object.
+// Unlike getSecret it does not export the object, so the private key may be
+// non-exportable.
+func (p *Provider) getPublicKey(
+	ctx context.Context,
+	client *client.SecretClient,
+	secretConfig config.Secret,
+) ([]byte, *sdkms.Sobject, error) {
+	secretName := secretConfig.Identifier()
+	sobjectreq := sobjectDescriptor(secretConfig.ObjectRef)
+	showPubKey := true
+	sobject, err := p.inFlight.do(ctx, flightKey(client, "publicKey", secretConfig.ObjectRef), func() (*sdkms.Sobject, error) {
+		return client.GetSobject(ctx, &sdkms.GetSobjectParams{ShowPubKey: &showPubKey}, *sobjectreq)
+	})
+	if err != nil {
+		log.Printf("Error! Could not fetch the Sobject %v: %v", secretName, err)
+		return nil, nil, err
+	}
+	if sobject.PubKey == nil {
+		return nil, nil, configError("Sobject %v has no public key", secretName)
+	}
+	content, err := encodeContent(secretConfig.Encoding, pemTypePublicKey, *sobject.PubKey)
+	if err != nil {
+		return nil, nil, configError("could not encode public key of Sobject %v: %w", secretName, err)
+	}
+	return content, sobject, nil
+}
+
+// sobjectDescriptor selects the security object by key ID when one is
+// configured, so that renaming the object in DSM cannot change what is mounted.
+func sobjectDescriptor(ref config.ObjectRef) *sdkms.SobjectDescriptor {
+	if ref.ObjectID != "" {
+		return sdkms.SobjectByID(ref.ObjectID)
 	}
-	return *sobject.Value, nil
+	return sdkms.SobjectByName(ref.SecretName)
 }
 
-func (p *provider) HandleMountRequest(
+// HandleMountRequest fetches the configured secrets. Secrets that the driver
+// reports as mounted in currentObjectVersions, and whose security objects are
+// unchanged in DSM, are served from the previous mount without exporting them
+// again. If DSM is unavailable, the secrets are served from the last-known-good
+// cache, if the SecretProviderClass opted into it.
+func (p *Provider) HandleMountRequest(
 	ctx context.Context,
 	cfg config.Config,
+	currentObjectVersions []*pb.ObjectVersion,
 ) (*pb.MountResponse, error) {
-	authconfig := config.SpcParameters{
+	mounts, err := p.fetchMounts(ctx, cfg, currentObjectVersions)
+	if err != nil {
+		mounts = p.cachedMounts(cfg, err)
+		if mounts == nil {
+			return nil, err
+		}
+	} else {
+		p.cacheMounts(cfg, mounts)
+	}
+
+	var files []*pb.File
+	var objectVersions []*pb.ObjectVersion
+	for i, secret := range cfg.Parameters.Secrets {
+		mounted := mounts[i]
+		filePermission := int32(cfg.FilePermission)
+		if secret.FilePermission != 0 {
+			filePermission = int32(secret.FilePermission)
+		}
+		for _, file := range mounted.files {
+			files = append(
+				files,
+				&pb.File{Path: file.path, Mode: filePermission, Contents: file.content},
+			)
+
+			log.Println(
+				"secret added to mount response",
+				"directory",
+				cfg.TargetPath,
+				"file:",
+				file.path,
+			)
+		}
+		objectVersions = append(objectVersions, mounted.objectVersion)
+	}
+	return &pb.MountResponse{
+		Files:         files,
+		ObjectVersion: objectVersions,
+	}, nil
+}
+
+// spcParameters returns the parameters of the DSM client for a mount.
+func spcParameters(cfg config.Config) config.SpcParameters {
+	return config.SpcParameters{
 		DsmEndpoint: cfg.Parameters.DsmEndpoint,
+		AuthMethod:  cfg.Parameters.AuthMethod,
 		ApiKey:      cfg.Parameters.DsmApiKey,
+		AppID:       cfg.Parameters.AppID,
+		JWT:         cfg.Parameters.ServiceAccountToken,
+		ClientCert:  cfg.Parameters.ClientCert,
+		ClientKey:   cfg.Parameters.ClientKey,
+		TLS:         cfg.Parameters.TLS,
+		Proxy:       cfg.Parameters.Proxy,
+		Timeouts:    cfg.Parameters.Timeouts,
+		RateLimits:  cfg.Parameters.RateLimits,
 	}
-	client, err := client.NewSecretClient(authconfig)
+}
+
+// fetchMounts fetches the configured secrets from DSM, or from the previous
+// mount if they are unchanged. It returns them in the configured order.
+func (p *Provider) fetchMounts(
+	ctx context.Context,
+	cfg config.Config,
+	currentObjectVersions []*pb.ObjectVersion,
+) ([]*mountedSecret, error) {
+	client, release, err := p.clients.get(spcParameters(cfg), time.Now())
 	if err != nil {
-		log.Fatalf("Error creating a new Client :%v", err)
-		return nil, err
+		log.Printf("Error creating a new Client :%v", err)
+		return nil, NewMountError(ErrorCodeConfigInvalid, err)
 	}
+	defer release()
+	mountCtx, cancel := mountContext(ctx)
+	defer cancel()
+	objectTimeout := cfg.Parameters.Timeouts.Object
 
-	var files []*pb.File
-	var objectVersions []*pb.ObjectVersion
+	if err := client.Authenticate(mountCtx); err != nil {
+		log.Printf("Error authenticating to DSM: %v", err)
+		return nil, err
+	}
 
-	for _, secret := range cfg.Parameters.Secrets {
-		log.Println("Fetching :", secret.SecretName)
+	p.evictIdleMounts(time.Now())
 
-		content, err := p.getSecret(ctx, client, secret)
+	secrets := cfg.Parameters.Secrets
+	keys := make([]string, len(secrets))
+	for i, secret := range secrets {
+		keys[i], err = mountedSecretKey(cfg.TargetPath, secret)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		hash := sha256.Sum256(content)
-		objectVersion := &pb.ObjectVersion{
-			Id: hex.EncodeToString(hash[:]),
+	// Secrets are checked and fetched in parallel, but returned in the
+	// configured order. First, secrets that are unchanged since the previous
+	// mount are looked up.
+	mounts := make([]*mountedSecret, len(secrets))
+	_ = forEachParallel(mountCtx, len(secrets), maxConcurrentFetches, func(ctx context.Context, i int) error {
+		ctx, cancel := withTimeout(ctx, objectTimeout)
+		defer cancel()
+		mounts[i] = p.unchangedMount(ctx, client, keys[i], secrets[i], currentObjectVersions)
+		if mounts[i] != nil {
+			log.Println("Unchanged, skipping export :", secrets[i].Identifier())
 		}
-		filePermission := int32(cfg.FilePermission)
-		if secret.FilePermission != 0 {
-			filePermission = int32(secret.FilePermission)
+		return nil
+	})
+
+	// The objects of the remaining secrets are exported in batch requests,
+	// before their files are built.
+	var refs []config.ObjectRef
+	for i, secret := range secrets {
+		if mounts[i] == nil && secret.Export != config.ExportPublicKey {
+			refs = append(refs, secret.ObjectRefs()...)
 		}
-		files = append(
-			files,
-			&pb.File{Path: secret.SecretName, Mode: filePermission, Contents: content},
-		)
-		objectVersions = append(objectVersions, objectVersion)
-
-		log.Println(
-			"secret added to mount response",
-			"directory",
-			cfg.TargetPath,
-			"file:",
-			secret.SecretName,
-		)
 	}
-	return &pb.MountResponse{
-		Files:         files,
-		ObjectVersion: objectVersions,
+	exported := p.batchExport(mountCtx, client, refs, objectTimeout)
+
+	err = forEachParallel(mountCtx, len(secrets), maxConcurrentFetches, func(ctx context.Context, i int) error {
+		if mounts[i] == nil {
+			objectCtx, cancel := withTimeout(ctx, objectTimeout)
+			defer cancel()
+			mounted, err := p.fetchSecret(objectCtx, client, exported, secrets[i])
+			if err != nil {
+				return objectTimeoutError(ctx, objectCtx, secrets[i], objectTimeout, err)
+			}
+			mounts[i] = mounted
+		}
+		p.storeMount(keys[i], mounts[i], time.Now())
+		return nil
+	})
+	if err != nil {
+		if errors.Is(mountCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			return nil, partialMountError(secrets, mounts)
+		}
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// fetchSecret fetches the files of a secret and derives its version.
+func (p *Provider) fetchSecret(
+	ctx context.Context,
+	client *client.SecretClient,
+	exported exportedSobjects,
+	secret config.Secret,
+) (*mountedSecret, error) {
+	log.Println("Fetching :", secret.Identifier())
+
+	secretFiles, sobjects, err := p.getSecret(ctx, client, exported, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	version := sobjectsVersion(sobjects)
+	objectVersion, err := generateObjectVersion(secret, p.hmacKey, version, secretFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &mountedSecret{
+		version:       version,
+		objectVersion: objectVersion,
+		files:         secretFiles,
 	}, nil
 }
 
+// generateObjectVersion returns the version of a secret reported to the
+// driver. The ID is stable across rotations. Without an HMAC key the version
+// is derived from DSM metadata; with one, it is an HMAC of the secret
+// configuration and contents, which does not reveal a fingerprint of the
+// contents to anyone without the node-local key.
 func generateObjectVersion(
 	secret config.Secret,
 	hmacKey []byte,
-	content []byte,
+	metadataVersion string,
+	files []secretFile,
 ) (*pb.ObjectVersion, error) {
 	if hmacKey == nil {
 		return &pb.ObjectVersion{
-			Id:      secret.SecretName,
-			Version: "",
+			Id:      secret.ObjectVersionID(),
+			Version: metadataVersion,
 		}, nil
 	}
 	hash := hmac.New(sha256.New, hmacKey)
@@ -120,11 +362,13 @@ func generateObjectVersion(
 	if _, err := hash.Write(cfg); err != nil {
 		return nil, err
 	}
-	if _, err := hash.Write(content); err != nil {
-		return nil, err
+	for _, file := range files {
+		if _, err := hash.Write(file.content); err != nil {
+			return nil, err
+		}
 	}
 	return &pb.ObjectVersion{
-		Id:      secret.SecretName,
+		Id:      secret.ObjectVersionID(),
 		Version: base64.URLEncoding.EncodeToString(hash.Sum(nil)),
 	}, nil
 }
@@ -0,0 +1,107 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/client"
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+)
+
+// flight is a DSM request in progress, whose result concurrent mounts
+// requesting the same object share.
+type flight struct {
+	done   chan struct{}
+	result exportResult
+	// ok is false if the leader gave up without a result, e.g. because its
+	// batch request failed.
+	ok bool
+}
+
+// flightGroup deduplicates concurrent identical DSM requests, so that e.g.
+// the replicas of a Deployment scaled up on a node share a single export of
+// each object.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// flightKey identifies a request for an object. It includes the endpoint and
+// credential, so that a mount is only ever served what its own credential
+// gives access to.
+func flightKey(client *client.SecretClient, operation string, ref config.ObjectRef) string {
+	return client.CredentialKey() + "\x00" + operation + "\x00" + ref.SecretName + "\x00" + ref.ObjectID
+}
+
+// claim returns the flight for key. If lead is true there was none, and the
+// caller must make the request and finish the flight.
+func (g *flightGroup) claim(key string) (f *flight, lead bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		return f, false
+	}
+	f = &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// finish completes a flight the caller leads. With ok false, waiting callers
+// make the request themselves.
+func (g *flightGroup) finish(key string, f *flight, result exportResult, ok bool) {
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	f.result, f.ok = result, ok
+	close(f.done)
+}
+
+// wait returns the result of a flight led by another caller. It returns false
+// if there is no result the caller can use, in which case it should make the
+// request itself.
+func (f *flight) wait(ctx context.Context) (exportResult, bool) {
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return exportResult{err: ctx.Err()}, true
+	}
+	// The leader's mount giving up does not make the request fail for
+	// others.
+	if errors.Is(f.result.err, context.Canceled) || errors.Is(f.result.err, context.DeadlineExceeded) {
+		return exportResult{}, false
+	}
+	return f.result, f.ok
+}
+
+// do makes a request through the group, unless an identical one is in
+// flight, in which case its result is shared.
+func (g *flightGroup) do(
+	ctx context.Context,
+	key string,
+	request func() (*sdkms.Sobject, error),
+) (*sdkms.Sobject, error) {
+	f, lead := g.claim(key)
+	if !lead {
+		if result, ok := f.wait(ctx); ok {
+			return result.sobject, result.err
+		}
+		return request()
+	}
+	var result exportResult
+	defer func() { g.finish(key, f, result, true) }()
+	result.sobject, result.err = request()
+	return result.sobject, result.err
+}
@@ -0,0 +1,115 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+)
+
+func TestFlightGroupClaimFinish(t *testing.T) {
+	g := newFlightGroup()
+	f, lead := g.claim("key")
+	if !lead {
+		t.Fatal("first claim does not lead")
+	}
+	if other, lead := g.claim("key"); lead || other != f {
+		t.Fatal("second claim does not follow the flight in progress")
+	}
+	if _, lead := g.claim("other-key"); !lead {
+		t.Error("claim of another key does not lead")
+	}
+
+	name := "db-password"
+	g.finish("key", f, exportResult{sobject: &sdkms.Sobject{Name: &name}}, true)
+	result, ok := f.wait(context.Background())
+	if !ok || result.sobject == nil || *result.sobject.Name != name {
+		t.Errorf("wait() = %+v, %v, want the result of the leader", result, ok)
+	}
+	if _, lead := g.claim("key"); !lead {
+		t.Error("claim after the flight finished does not lead")
+	}
+}
+
+func TestFlightWait(t *testing.T) {
+	errExport := errors.New("export failed")
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		finish  bool
+		result  exportResult
+		ok      bool
+		wantErr error
+		wantOK  bool
+	}{
+		{name: "shared error", ctx: context.Background(), finish: true, result: exportResult{err: errExport}, ok: true, wantErr: errExport, wantOK: true},
+		{name: "no result", ctx: context.Background(), finish: true},
+		{name: "leader canceled", ctx: context.Background(), finish: true, result: exportResult{err: context.Canceled}, ok: true},
+		{name: "leader timed out", ctx: context.Background(), finish: true, result: exportResult{err: context.DeadlineExceeded}, ok: true},
+		{name: "waiter canceled", ctx: canceled, wantErr: context.Canceled, wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newFlightGroup()
+			f, _ := g.claim("key")
+			if tt.finish {
+				g.finish("key", f, tt.result, tt.ok)
+			}
+			result, ok := f.wait(tt.ctx)
+			if ok != tt.wantOK || !errors.Is(result.err, tt.wantErr) {
+				t.Errorf("wait() = %v, %v, want %v, %v", result.err, ok, tt.wantErr, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFlightGroupDoShares(t *testing.T) {
+	g := newFlightGroup()
+	name := "db-password"
+	started := make(chan struct{})
+	release := make(chan struct{})
+	leader := make(chan *sdkms.Sobject, 1)
+	go func() {
+		sobject, _ := g.do(context.Background(), "key", func() (*sdkms.Sobject, error) {
+			close(started)
+			<-release
+			return &sdkms.Sobject{Name: &name}, nil
+		})
+		leader <- sobject
+	}()
+	<-started
+
+	var requests atomic.Int32
+	follower := make(chan *sdkms.Sobject, 1)
+	go func() {
+		sobject, _ := g.do(context.Background(), "key", func() (*sdkms.Sobject, error) {
+			requests.Add(1)
+			return nil, errors.New("unexpected request")
+		})
+		follower <- sobject
+	}()
+	// Give the follower time to find the flight in progress.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if sobject := <-follower; sobject == nil || *sobject.Name != name {
+		t.Errorf("follower got %v, want the result of the leader", sobject)
+	}
+	if sobject := <-leader; sobject == nil || *sobject.Name != name {
+		t.Errorf("leader got %v", sobject)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("follower made %d requests, want none", n)
+	}
+}
@@ -0,0 +1,167 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/client"
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+	pb "github.com/fortanix/fortanix-csi-provider/internal/v1alpha1"
+)
+
+// mountIdleTimeout bounds how long the files of a mount are kept after the
+// driver last requested them. Rotation polls happen well within it, while
+// mounts of deleted pods are dropped eventually.
+const mountIdleTimeout = time.Hour
+
+// mountedSecret is the result of the last mount of a secret into a target path.
+type mountedSecret struct {
+	// version is derived from the DSM metadata of the security objects the
+	// files were built from.
+	version       string
+	objectVersion *pb.ObjectVersion
+	files         []secretFile
+	lastUsed      time.Time
+}
+
+// mountedSecretKey identifies a secret mounted into a target path. It covers
+// the whole secret configuration, so that changing e.g. its encoding forces
+// the secret to be exported again.
+func mountedSecretKey(targetPath string, secret config.Secret) (string, error) {
+	cfg, err := json.Marshal(secret)
+	if err != nil {
+		return "", err
+	}
+	return targetPath + "\x00" + string(cfg), nil
+}
+
+// unchangedMount returns the previous mount of a secret if the driver reports
+// it as currently mounted and none of its security objects changed in DSM
+// since. The check only reads object metadata, nothing is exported.
+func (p *Provider) unchangedMount(
+	ctx context.Context,
+	client *client.SecretClient,
+	key string,
+	secret config.Secret,
+	currentObjectVersions []*pb.ObjectVersion,
+) *mountedSecret {
+	p.mu.Lock()
+	mounted := p.mounts[key]
+	p.mu.Unlock()
+	if mounted == nil || !containsObjectVersion(currentObjectVersions, mounted.objectVersion) {
+		return nil
+	}
+
+	version, err := p.metadataVersion(ctx, client, secret)
+	if err != nil {
+		log.Printf("Could not check the version of %v, exporting it: %v", secret.Identifier(), err)
+		return nil
+	}
+	if version != mounted.version {
+		return nil
+	}
+	return mounted
+}
+
+func (p *Provider) storeMount(key string, mounted *mountedSecret, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	mounted.lastUsed = now
+	p.mounts[key] = mounted
+}
+
+func (p *Provider) evictIdleMounts(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, mounted := range p.mounts {
+		if now.Sub(mounted.lastUsed) > mountIdleTimeout {
+			delete(p.mounts, key)
+		}
+	}
+}
+
+// metadataVersion looks up the security objects of a secret without their
+// values and returns the same version sobjectsVersion returns for the
+// exported objects.
+func (p *Provider) metadataVersion(
+	ctx context.Context,
+	client *client.SecretClient,
+	secret config.Secret,
+) (string, error) {
+	showValue := false
+	var sobjects []*sdkms.Sobject
+	for _, ref := range secret.ObjectRefs() {
+		sobject, err := client.GetSobject(ctx, &sdkms.GetSobjectParams{ShowValue: &showValue}, *sobjectDescriptor(ref))
+		if err != nil {
+			return "", err
+		}
+		// A disabled, deactivated or compromised object must not be served
+		// from a previous mount, exporting it again lets DSM decide.
+		if !sobjectActive(sobject) {
+			return "", fmt.Errorf("security object %v is not active", ref.Identifier())
+		}
+		sobjects = append(sobjects, sobject)
+	}
+	return sobjectsVersion(sobjects), nil
+}
+
+// sobjectsVersion derives a version from the metadata of security objects.
+// Key material cannot change in place in DSM, rotating an object creates a
+// new one with a new key ID, so the key ID and creation time identify it.
+// The lifecycle fields are included so that revoking an object is noticed.
+func sobjectsVersion(sobjects []*sdkms.Sobject) string {
+	hash := sha256.New()
+	for _, sobject := range sobjects {
+		var kid, kcv, state string
+		var deactivationDate, compromiseDate sdkms.Time
+		if sobject.Kid != nil {
+			kid = *sobject.Kid
+		}
+		if sobject.Kcv != nil {
+			kcv = *sobject.Kcv
+		}
+		if sobject.State != nil {
+			state = string(*sobject.State)
+		}
+		if sobject.DeactivationDate != nil {
+			deactivationDate = *sobject.DeactivationDate
+		}
+		if sobject.CompromiseDate != nil {
+			compromiseDate = *sobject.CompromiseDate
+		}
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%t\x00%s\x00%s\x00%s\x00",
+			kid, sobject.CreatedAt, kcv, sobject.Enabled, state, deactivationDate, compromiseDate)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// sobjectActive reports whether a security object is enabled and, if DSM
+// reports its state, in the Active state.
+func sobjectActive(sobject *sdkms.Sobject) bool {
+	if !sobject.Enabled {
+		return false
+	}
+	return sobject.State == nil || *sobject.State == sdkms.SobjectStateActive
+}
+
+func containsObjectVersion(objectVersions []*pb.ObjectVersion, objectVersion *pb.ObjectVersion) bool {
+	for _, v := range objectVersions {
+		if v.GetId() == objectVersion.GetId() && v.GetVersion() == objectVersion.GetVersion() {
+			return true
+		}
+	}
+	return false
+}
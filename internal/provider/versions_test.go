@@ -0,0 +1,178 @@
+/* Copyright (c) Fortanix, Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fortanix/sdkms-client-go/sdkms"
+
+	"github.com/fortanix/fortanix-csi-provider/internal/client"
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
+	pb "github.com/fortanix/fortanix-csi-provider/internal/v1alpha1"
+)
+
+// newTestClient returns a client of a DSM stub that authenticates every
+// request and serves the other requests with handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *client.SecretClient {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sys/v1/session/auth" {
+			_ = json.NewEncoder(w).Encode(sdkms.AuthenticationResponse{
+				ExpiresIn:   600,
+				AccessToken: "token",
+			})
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	secretClient, err := client.NewSecretClient(config.SpcParameters{
+		DsmEndpoint: server.URL,
+		ApiKey:      "api-key",
+		TLS: config.TLSConfig{
+			CACert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secretClient
+}
+
+func testSobject(kid string, enabled bool, state sdkms.SobjectState) *sdkms.Sobject {
+	return &sdkms.Sobject{
+		Kid:       &kid,
+		CreatedAt: "20240101T000000Z",
+		Creator:   sdkms.Principal{System: &struct{}{}},
+		Enabled:   enabled,
+		State:     &state,
+	}
+}
+
+func TestSobjectActive(t *testing.T) {
+	tests := []struct {
+		name    string
+		sobject *sdkms.Sobject
+		want    bool
+	}{
+		{name: "active", sobject: testSobject("kid", true, sdkms.SobjectStateActive), want: true},
+		{name: "no state", sobject: &sdkms.Sobject{Enabled: true}, want: true},
+		{name: "disabled", sobject: testSobject("kid", false, sdkms.SobjectStateActive)},
+		{name: "deactivated", sobject: testSobject("kid", true, sdkms.SobjectStateDeactivated)},
+		{name: "compromised", sobject: testSobject("kid", true, sdkms.SobjectStateCompromised)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sobjectActive(tt.sobject); got != tt.want {
+				t.Errorf("sobjectActive() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSobjectsVersion(t *testing.T) {
+	base := sobjectsVersion([]*sdkms.Sobject{testSobject("kid", true, sdkms.SobjectStateActive)})
+	if again := sobjectsVersion([]*sdkms.Sobject{testSobject("kid", true, sdkms.SobjectStateActive)}); again != base {
+		t.Errorf("version of the same object changed: %s != %s", again, base)
+	}
+	compromiseDate := sdkms.Time("20240201T000000Z")
+	compromised := testSobject("kid", true, sdkms.SobjectStateActive)
+	compromised.CompromiseDate = &compromiseDate
+	changes := map[string]*sdkms.Sobject{
+		"rotated":         testSobject("other-kid", true, sdkms.SobjectStateActive),
+		"disabled":        testSobject("kid", false, sdkms.SobjectStateActive),
+		"deactivated":     testSobject("kid", true, sdkms.SobjectStateDeactivated),
+		"compromise date": compromised,
+	}
+	for name, sobject := range changes {
+		if version := sobjectsVersion([]*sdkms.Sobject{sobject}); version == base {
+			t.Errorf("%s: version did not change", name)
+		}
+	}
+}
+
+func TestUnchangedMount(t *testing.T) {
+	secret := config.Secret{ObjectRef: config.ObjectRef{SecretName: "db-password"}}
+	mountedVersion := sobjectsVersion([]*sdkms.Sobject{testSobject("kid", true, sdkms.SobjectStateActive)})
+	objectVersion := &pb.ObjectVersion{Id: "db-password", Version: "v1"}
+	tests := []struct {
+		name           string
+		current        []*pb.ObjectVersion
+		sobject        *sdkms.Sobject
+		status         int
+		wantReused     bool
+		wantDSMLookups int32
+	}{
+		{
+			name:           "unchanged",
+			current:        []*pb.ObjectVersion{objectVersion},
+			sobject:        testSobject("kid", true, sdkms.SobjectStateActive),
+			wantReused:     true,
+			wantDSMLookups: 1,
+		},
+		{
+			name:    "not mounted by the driver",
+			current: []*pb.ObjectVersion{{Id: "db-password", Version: "v0"}},
+		},
+		{
+			name:           "rotated",
+			current:        []*pb.ObjectVersion{objectVersion},
+			sobject:        testSobject("new-kid", true, sdkms.SobjectStateActive),
+			wantDSMLookups: 1,
+		},
+		{
+			name:           "revoked",
+			current:        []*pb.ObjectVersion{objectVersion},
+			sobject:        testSobject("kid", true, sdkms.SobjectStateCompromised),
+			wantDSMLookups: 1,
+		},
+		{
+			name:           "lookup failed",
+			current:        []*pb.ObjectVersion{objectVersion},
+			status:         http.StatusNotFound,
+			wantDSMLookups: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lookups atomic.Int32
+			secretClient := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/crypto/v1/keys/info" {
+					http.NotFound(w, r)
+					return
+				}
+				lookups.Add(1)
+				if tt.status != 0 {
+					http.Error(w, "object not found", tt.status)
+					return
+				}
+				if err := json.NewEncoder(w).Encode(tt.sobject); err != nil {
+					t.Error(err)
+				}
+			})
+
+			p := NewProvider(nil, nil)
+			mounted := &mountedSecret{version: mountedVersion, objectVersion: objectVersion}
+			p.storeMount("key", mounted, time.Now())
+			got := p.unchangedMount(context.Background(), secretClient, "key", secret, tt.current)
+			if (got == mounted) != tt.wantReused {
+				t.Errorf("unchangedMount() = %v, want reused %v", got, tt.wantReused)
+			}
+			if n := lookups.Load(); n != tt.wantDSMLookups {
+				t.Errorf("DSM lookups = %d, want %d", n, tt.wantDSMLookups)
+			}
+		})
+	}
+}
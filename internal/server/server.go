@@ -10,6 +10,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/fortanix/fortanix-csi-provider/internal/config"
 	provider "github.com/fortanix/fortanix-csi-provider/internal/provider"
@@ -22,6 +23,42 @@ var _ pb.CSIDriverProviderServer = (*Server)(nil)
 type Server struct {
 	DsmApiKey   string
 	DsmEndpoint string
+
+	flags    config.FlagsConfig
+	provider *provider.Provider
+}
+
+// NewServer returns a Server whose provider is shared across mount requests,
+// so that unchanged objects are not exported again on rotation. The
+// last-known-good cache is enabled if flags set a cache directory.
+func NewServer(flags config.FlagsConfig) (*Server, error) {
+	var hmacKey []byte
+	if flags.ObjectVersionKeyFile != "" {
+		var err error
+		hmacKey, err = os.ReadFile(flags.ObjectVersionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read object version key: %w", err)
+		}
+		if len(hmacKey) == 0 {
+			return nil, fmt.Errorf("object version key file %s is empty", flags.ObjectVersionKeyFile)
+		}
+	}
+	var cache *provider.Cache
+	if flags.CacheDir != "" {
+		cacheKey, err := os.ReadFile(flags.CacheKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cache key: %w", err)
+		}
+		cache, err = provider.NewCache(flags.CacheDir, cacheKey, flags.CacheMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cache: %w", err)
+		}
+	}
+	return &Server{
+		DsmEndpoint: flags.DsmEndpoint,
+		flags:       flags,
+		provider:    provider.NewProvider(hmacKey, cache),
+	}, nil
 }
 
 func (s *Server) Version(context.Context, *pb.VersionRequest) (*pb.VersionResponse, error) {
@@ -35,25 +72,44 @@ func (s *Server) Version(context.Context, *pb.VersionRequest) (*pb.VersionRespon
 func (s *Server) Mount(ctx context.Context, req *pb.MountRequest) (*pb.MountResponse, error) {
 	cfg, err := config.Parse(
 		req.Attributes,
+		req.Secrets,
 		req.TargetPath,
 		req.Permission,
+		s.flags,
 	)
 	if err != nil {
 		log.Printf("Error parsing config: %v", err)
-		return nil, fmt.Errorf("failed to parse config: %w", err)
+		return mountError(provider.NewMountError(
+			provider.ErrorCodeConfigInvalid,
+			fmt.Errorf("failed to parse config: %w", err),
+		))
 	}
 
-	if cfg.Parameters.DsmEndpoint == "" || cfg.Parameters.DsmApiKey == "" {
+	if cfg.Parameters.DsmEndpoint == "" {
 		log.Println("SecretProviderClass not found or invalid")
-		return nil, fmt.Errorf("SecretProviderClass not found or invalid")
+		return mountError(provider.NewMountError(
+			provider.ErrorCodeConfigInvalid,
+			fmt.Errorf("SecretProviderClass not found or invalid"),
+		))
 	}
 
-	provider := provider.NewProvider()
-	resp, err := provider.HandleMountRequest(ctx, cfg)
+	resp, err := s.provider.HandleMountRequest(ctx, cfg, req.CurrentObjectVersion)
 	if err != nil {
 		log.Printf("Error handling mount request: %v", err)
-		return nil, fmt.Errorf("error making mount request: %w", err)
+		return mountError(fmt.Errorf("error making mount request: %w", err))
 	}
 
 	return resp, nil
 }
+
+// mountError classifies a failed mount. The driver only reads
+// MountResponse.Error of a successful call, and reports a failed call as a
+// generic provider error, so the error code is returned in the response and
+// the call itself succeeds. The driver reports nothing but the code, so the
+// error itself, e.g. which objects a mount ran out of time on, is only logged
+// here, along with the gRPC status closest to the code.
+func mountError(err error) (*pb.MountResponse, error) {
+	code := provider.Classify(err)
+	log.Printf("Mount failed with error code %s (gRPC status %s): %v", code, code.GRPCCode(), err)
+	return &pb.MountResponse{Error: &pb.Error{Code: string(code)}}, nil
+}
@@ -7,6 +7,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -20,6 +21,8 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/status"
 
+	"github.com/fortanix/fortanix-csi-provider/internal/client"
+	"github.com/fortanix/fortanix-csi-provider/internal/config"
 	providerserver "github.com/fortanix/fortanix-csi-provider/internal/server"
 	pb "github.com/fortanix/fortanix-csi-provider/internal/v1alpha1"
 	"github.com/fortanix/fortanix-csi-provider/internal/version"
@@ -33,12 +36,101 @@ func realMain() error {
 			"path to socket on which to listen for driver gRPC calls",
 		)
 		selfVersion = flag.Bool("version", false, "prints the version information")
-		dsmAddr     = flag.String("dsm-address", "https://api.smartkey.io", "Fortanix API URL")
-		healthAddr  = flag.String(
+		dsmAddr     = flag.String(
+			"dsm-address",
+			defaultDsmAddress(),
+			"Fortanix API URL, used by SecretProviderClasses without a dsmEndpoint and the only one node credentials are sent to",
+		)
+		healthAddr = flag.String(
 			"health-address",
 			":8080",
 			"configure http listener for reporting health",
 		)
+		allowNodeCredentials = flag.Bool(
+			"allow-node-credentials",
+			true,
+			"use the FORTANIX_API_KEY environment variable for SecretProviderClasses without a nodePublishSecretRef",
+		)
+		clientCertFile = flag.String(
+			"client-cert-file",
+			"",
+			"path to a PEM client certificate for SecretProviderClasses using certificate authentication without a nodePublishSecretRef",
+		)
+		clientKeyFile = flag.String(
+			"client-key-file",
+			"",
+			"path to the PEM private key of --client-cert-file",
+		)
+		objectVersionKeyFile = flag.String(
+			"object-version-key-file",
+			"",
+			"path to a node-local key used to derive object versions as an HMAC, defaults to DSM metadata",
+		)
+		dsmCAFile = flag.String(
+			"dsm-ca-file",
+			"",
+			"path to PEM CA certificates trusted for the DSM endpoint in addition to the system roots",
+		)
+		dsmTLSMinVersion = flag.String("dsm-tls-min-version", "1.2", "minimum TLS version for DSM, 1.2 or 1.3")
+		dsmTLSServerName = flag.String(
+			"dsm-tls-server-name",
+			"",
+			"server name sent in SNI and verified against the DSM certificate, defaults to the endpoint host",
+		)
+		dsmPinnedCertSHA256 = flag.String(
+			"dsm-pinned-cert-sha256",
+			"",
+			"comma separated hex SHA-256 hashes of SubjectPublicKeyInfos, one of which the DSM certificate chain must contain",
+		)
+		dsmProxyURL = flag.String(
+			"dsm-proxy-url",
+			"",
+			"URL of the proxy to reach DSM through, defaults to the HTTPS_PROXY environment variable",
+		)
+		dsmNoProxy = flag.String(
+			"dsm-no-proxy",
+			"",
+			"comma separated hosts, domains and CIDRs reached without --dsm-proxy-url, like NO_PROXY",
+		)
+		dsmProxyCAFile    = flag.String("dsm-proxy-ca-file", "", "path to PEM CA certificates trusted for an HTTPS proxy")
+		dsmConnectTimeout = flag.Duration(
+			"dsm-connect-timeout",
+			10*time.Second,
+			"timeout for connecting to DSM, including the TLS handshake, 0 for none",
+		)
+		dsmReadTimeout = flag.Duration(
+			"dsm-read-timeout",
+			30*time.Second,
+			"timeout for the response to a DSM request, 0 for none",
+		)
+		objectTimeout = flag.Duration(
+			"object-timeout",
+			30*time.Second,
+			"timeout for fetching a single object including retries, 0 for none",
+		)
+		cacheDir = flag.String(
+			"cache-dir",
+			"",
+			"directory of the last-known-good cache served while DSM is unavailable, which SecretProviderClasses opt into",
+		)
+		cacheKeyFile = flag.String("cache-key-file", "", "path to the node-local key the cache is encrypted with")
+		cacheMaxAge  = flag.Duration("cache-max-age", 24*time.Hour, "maximum age of cached secrets that are served")
+		dsmRateLimit = flag.Float64(
+			"dsm-rate-limit",
+			0,
+			"maximum requests per second to a DSM endpoint, 0 for unlimited",
+		)
+		dsmRateBurst           = flag.Int("dsm-rate-burst", 20, "requests to a DSM endpoint that can be made at once")
+		dsmCredentialRateLimit = flag.Float64(
+			"dsm-credential-rate-limit",
+			0,
+			"maximum requests per second with a single DSM credential, 0 for unlimited",
+		)
+		dsmCredentialRateBurst = flag.Int(
+			"dsm-credential-rate-burst",
+			10,
+			"requests with a single DSM credential that can be made at once",
+		)
 	)
 
 	flag.Parse()
@@ -59,11 +151,18 @@ func realMain() error {
 				startTime := time.Now()
 				log.Printf("Processing unary gRPC call grpc.method: %v", info.FullMethod)
 				resp, err := handler(ctx, req)
+				// Failed mounts succeed at the gRPC level and carry their
+				// error code in the response, see server.mountError.
+				var providerCode string
+				if mountResp, ok := resp.(*pb.MountResponse); ok && mountResp.GetError() != nil {
+					providerCode = mountResp.GetError().GetCode()
+				}
 				log.Printf(
-					"Finished unary gRPC call grpc.method: %v, grpc.time: %v, grpc.code: %v",
+					"Finished unary gRPC call grpc.method: %v, grpc.time: %v, grpc.code: %v, provider.code: %v",
 					info.FullMethod,
 					time.Since(startTime),
 					status.Code(err),
+					providerCode,
 				)
 				if err != nil {
 					log.Printf("Error: %v", err.Error())
@@ -88,8 +187,38 @@ func realMain() error {
 	}
 	defer listener.Close()
 
-	s := &providerserver.Server{
-		DsmEndpoint: *dsmAddr,
+	s, err := providerserver.NewServer(config.FlagsConfig{
+		Endpoint:             *endpoint,
+		DsmEndpoint:          *dsmAddr,
+		HealthAddr:           *healthAddr,
+		AllowNodeCredentials: *allowNodeCredentials,
+		ClientCertFile:       *clientCertFile,
+		ClientKeyFile:        *clientKeyFile,
+		ObjectVersionKeyFile: *objectVersionKeyFile,
+		DsmCAFile:            *dsmCAFile,
+		DsmTLSMinVersion:     *dsmTLSMinVersion,
+		DsmTLSServerName:     *dsmTLSServerName,
+		DsmPinnedCertSHA256:  *dsmPinnedCertSHA256,
+		DsmProxyURL:          *dsmProxyURL,
+		DsmNoProxy:           *dsmNoProxy,
+		DsmProxyCAFile:       *dsmProxyCAFile,
+		Timeouts: config.Timeouts{
+			Connect: *dsmConnectTimeout,
+			Read:    *dsmReadTimeout,
+			Object:  *objectTimeout,
+		},
+		CacheDir:     *cacheDir,
+		CacheKeyFile: *cacheKeyFile,
+		CacheMaxAge:  *cacheMaxAge,
+		RateLimits: config.RateLimits{
+			EndpointRate:    *dsmRateLimit,
+			EndpointBurst:   *dsmRateBurst,
+			CredentialRate:  *dsmCredentialRateLimit,
+			CredentialBurst: *dsmCredentialRateBurst,
+		},
+	})
+	if err != nil {
+		return err
 	}
 	pb.RegisterCSIDriverProviderServer(server, s)
 
@@ -109,6 +238,18 @@ func realMain() error {
 	mux.HandleFunc("/health/ready", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
+	mux.HandleFunc("/health/dsm", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(client.BreakerStates()); err != nil {
+			log.Printf("Error writing DSM health, err: %v", err.Error())
+		}
+	})
+	mux.HandleFunc("/metrics/dsm", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(client.RateLimitMetrics()); err != nil {
+			log.Printf("Error writing DSM metrics, err: %v", err.Error())
+		}
+	})
 
 	// Start health handler
 	go func() {
@@ -127,6 +268,15 @@ func realMain() error {
 	return nil
 }
 
+// defaultDsmAddress keeps the FORTANIX_DSM_ENDPOINT environment variable
+// working as the node's DSM endpoint.
+func defaultDsmAddress() string {
+	if endpoint := os.Getenv("FORTANIX_DSM_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	return "https://api.smartkey.io"
+}
+
 func listen(endpoint string) (net.Listener, error) {
 	_, err := os.Stat(endpoint)
 	if err != nil && !os.IsNotExist(err) {